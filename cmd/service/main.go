@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"runtime"
 	"win-sense-connect/internal/bgService"
 
 	"github.com/kardianos/service"
@@ -10,8 +12,31 @@ import (
 func main() {
 	svcConfig := &service.Config{
 		Name:        "WinSenseConnect",
-		DisplayName: "MQTT Powershell Automation Service",
-		Description: "Listens for MQTT messages and runs PowerShell scripts",
+		DisplayName: "WinSenseConnect MQTT Automation Service",
+		Description: "Listens for MQTT messages, runs scripts and publishes sensor data",
+	}
+	// These are systemd unit directives; the Windows SCM would take them as the
+	// names of services to depend on and refuse to install
+	if runtime.GOOS == "linux" {
+		svcConfig.Dependencies = []string{
+			"After=network-online.target",
+			"Wants=network-online.target",
+		}
+	}
+
+	// install, uninstall, start, stop and restart manage the service with the
+	// platform's service manager (SCM on Windows, systemd on Linux)
+	if len(os.Args) > 1 {
+		s, err := service.New(nil, svcConfig)
+		if err != nil {
+			fmt.Printf("Failed to create service: %v\n", err)
+			os.Exit(1)
+		}
+		if err := service.Control(s, os.Args[1]); err != nil {
+			fmt.Printf("Failed to %s service: %v\nValid actions: %q\n", os.Args[1], err, service.ControlAction)
+			os.Exit(1)
+		}
+		return
 	}
 
 	prg, err := bgService.NewProgram()
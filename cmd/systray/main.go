@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"win-sense-connect/internal/appSystray"
 	"win-sense-connect/internal/appSystray/icon"
@@ -71,8 +74,17 @@ func loadConfig() error {
 		log.Println("Warning: No hotkey commands found in the database")
 	}
 
+	// Fall back to the default address so the dashboard item keeps working
+	dashboardURL := common.Config{}.DashboardURL()
+	if serviceConfig, err := db.GetConfig(); err != nil {
+		log.Printf("Warning: Failed to get service configuration, using %s for the dashboard: %v\n", dashboardURL, err)
+	} else {
+		dashboardURL = serviceConfig.DashboardURL()
+	}
+
 	config = common.SystrayConfig{
 		HotkeyCommands: hotkeyCommands,
+		DashboardURL:   dashboardURL,
 	}
 
 	log.Printf("Loaded configuration with %d hotkey commands\n", len(config.HotkeyCommands))
@@ -95,7 +107,7 @@ func onReady() {
 		for {
 			select {
 			case <-mShowQuickShortcuts.ClickedCh:
-				if err := appSystray.OpenURLInBrowser("http://localhost:8077"); err != nil {
+				if err := appSystray.OpenURLInBrowser(config.DashboardURL); err != nil {
 					log.Printf("Error opening shortcuts view: %v", err)
 				}
 			case <-mQuit.ClickedCh:
@@ -148,10 +160,43 @@ func parseHotkey(hotkey string) []string {
 	return keys
 }
 
+// executeCommand runs a hotkey command in the user's session and records it in
+// the script run history, like the service does for the runs it executes.
 func executeCommand(command string) {
 	log.Printf("Executing command: %s\n", command)
+	run := common.ScriptRun{
+		Command:   command,
+		Source:    common.RunSourceHotkey,
+		Status:    common.RunStatusRunning,
+		StartedAt: time.Now().UTC(),
+	}
+	if err := db.CreateScriptRun(&run); err != nil {
+		log.Printf("Error recording hotkey run: %v\n", err)
+	}
+
+	var stdout, stderr bytes.Buffer
 	cmd := exec.Command("cmd", "/C", command)
-	if err := cmd.Run(); err != nil {
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	run.EndedAt = time.Now().UTC()
+	run.Stdout = common.TruncateRunOutput(stdout.String())
+	run.Stderr = common.TruncateRunOutput(stderr.String())
+	run.Status = common.RunStatusSuccess
+	if err != nil {
 		log.Printf("Error executing command: %v\n", err)
+		run.Status = common.RunStatusFailed
+		run.ExitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			run.ExitCode = exitErr.ExitCode()
+		}
+	}
+	if run.ID == 0 {
+		return
+	}
+	if err := db.UpdateScriptRun(&run); err != nil {
+		log.Printf("Error recording hotkey run %d: %v\n", run.ID, err)
 	}
 }
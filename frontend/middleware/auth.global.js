@@ -0,0 +1,14 @@
+export default defineNuxtRouteMiddleware(async (to) => {
+  if (to.path === '/login') {
+    return
+  }
+
+  try {
+    const status = await $fetch('/api/auth/status')
+    if (!status.authenticated) {
+      return navigateTo('/login')
+    }
+  } catch (error) {
+    console.error('Failed to check authentication:', error)
+  }
+})
@@ -5,6 +5,13 @@ export default defineNuxtConfig({
   ssr: false,
   modules: ['@nuxtjs/tailwindcss', '@nuxt/icon'],
   css: ['@/assets/css/tailwind.css'],
+  // The generated site is served by the service; in development, forward API
+  // calls to a locally running service
+  nitro: {
+    devProxy: {
+      '/api': { target: 'http://localhost:8077/api', changeOrigin: true },
+    },
+  },
   app: {
     head: {
       title: 'WinSense',
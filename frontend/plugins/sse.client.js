@@ -1,7 +1,7 @@
 import { defineNuxtPlugin } from '#app'
 
 export default defineNuxtPlugin((nuxtApp) => {
-  const eventSource = new EventSource(`http://localhost:8077/api/events`);
+  const eventSource = new EventSource(`/api/events`);
   const subscribers = new Set();
 
   eventSource.onmessage = function(event) {
@@ -0,0 +1,270 @@
+package bgService
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookieName = "winsense_session"
+	sessionLifetime   = 7 * 24 * time.Hour
+	minPasswordLength = 8
+	// apiTokenPrefix makes API tokens recognizable, e.g. in secret scanners
+	apiTokenPrefix = "wsc_"
+	// tokenLastUsedInterval limits how often last_used_at is written for a
+	// token that is used for every request
+	tokenLastUsedInterval = time.Minute
+	// setupTokenFile holds the token that allows creating the first account
+	// from another computer
+	setupTokenFile = "data/setup-token.txt"
+)
+
+// publicAPIRoutes can be used without logging in, so the dashboard can find out
+// whether it has to show the setup or the login page.
+var publicAPIRoutes = map[string]bool{
+	"/api/auth/status": true,
+	"/api/auth/setup":  true,
+	"/api/auth/login":  true,
+	"/api/health":      true,
+}
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// setupRequest creates the first account. Requests from other computers need
+// the setup token, so nobody else on the network can claim the service first.
+type setupRequest struct {
+	credentials
+	SetupToken string `json:"setup_token"`
+}
+
+type authStatus struct {
+	SetupRequired bool `json:"setup_required"`
+	// SetupTokenRequired tells the dashboard to ask for the setup token
+	SetupTokenRequired bool   `json:"setup_token_required"`
+	Authenticated      bool   `json:"authenticated"`
+	Username           string `json:"username,omitempty"`
+}
+
+// newAPITokenResponse is returned once when a token is created; only its hash
+// is stored.
+type newAPITokenResponse struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+// newSecret returns a random, URL safe secret for a session or API token.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSecret hashes a session or API token for storage. The secrets are random
+// and long, so a fast hash is enough; passwords use bcrypt instead.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %v", err)
+	}
+	return string(hash), nil
+}
+
+func checkCredentials(c credentials) error {
+	if strings.TrimSpace(c.Username) == "" {
+		return fmt.Errorf("username is required")
+	}
+	if len(c.Password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	return nil
+}
+
+// requiresAuth reports whether path needs a session or API token: the API and
+// /metrics, which exposes the command names and host details. Only the
+// dashboard's static files stay public so the login page can load.
+func requiresAuth(path string) bool {
+	if publicAPIRoutes[path] {
+		return false
+	}
+	return strings.HasPrefix(path, "/api/") || path == "/metrics"
+}
+
+// initSetupToken creates the setup token while no account exists, and writes
+// it to setupTokenFile, which only administrators of this computer can read.
+func (p *program) initSetupToken() error {
+	path := resolveConfigPath(setupTokenFile)
+	count, err := p.db.CountUsers()
+	if err != nil {
+		return fmt.Errorf("failed to count users: %v", err)
+	}
+	if count > 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+		return nil
+	}
+
+	token, err := newSecret()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	p.setupToken = token
+	p.Logger.Warn("No account exists yet. Create it in the dashboard on this computer, or from another one with the setup token", "file", path)
+	return nil
+}
+
+// setupAllowed reports whether r may create the first account: it comes from
+// this computer or carries the setup token.
+func (p *program) setupAllowed(r *http.Request, token string) bool {
+	if isLoopback(r) {
+		return true
+	}
+	return p.setupToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(p.setupToken)) == 1
+}
+
+func isLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authMiddleware rejects requests that need authentication but carry neither a
+// valid API token nor a valid session cookie.
+func (p *program) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requiresAuth(r.URL.Path) || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := p.authenticate(r); !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="WinSenseConnect"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate checks the request's API token or session cookie and returns
+// the name of who made it.
+func (p *program) authenticate(r *http.Request) (string, bool) {
+	if token := requestToken(r); token != "" {
+		apiToken, err := p.db.GetAPITokenByHash(hashSecret(token))
+		if err != nil {
+			return "", false
+		}
+		if time.Since(apiToken.LastUsedAt) > tokenLastUsedInterval {
+			if err := p.db.UpdateAPITokenLastUsed(apiToken.ID, time.Now()); err != nil {
+				p.Logger.Error(fmt.Sprintf("Failed to update last use of API token '%s': %v", apiToken.Name, err))
+			}
+		}
+		return "token:" + apiToken.Name, true
+	}
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", false
+	}
+	user, err := p.db.GetSessionUser(hashSecret(cookie.Value))
+	if err != nil {
+		return "", false
+	}
+	return user.Username, true
+}
+
+// requestToken returns the bearer token of the request. EventSource can't set
+// headers, so the event stream also accepts it as the access_token parameter.
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, found := strings.Cut(header, " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	if r.URL.Path == "/api/events" {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// startSession logs user in by setting a session cookie.
+func (p *program) startSession(w http.ResponseWriter, r *http.Request, user *User) error {
+	if err := p.db.DeleteExpiredSessions(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to delete expired sessions: %v", err))
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		return err
+	}
+	session := Session{
+		TokenHash: hashSecret(secret),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(sessionLifetime),
+	}
+	if err := p.db.CreateSession(&session); err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    secret,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// endSession logs out the session of the request, if any.
+func (p *program) endSession(w http.ResponseWriter, r *http.Request) error {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	return p.db.DeleteSession(hashSecret(cookie.Value))
+}
@@ -0,0 +1,262 @@
+package bgService
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequiresAuth(t *testing.T) {
+	tests := []struct {
+		path string
+		auth bool
+	}{
+		{path: "/api/auth/status"},
+		{path: "/api/auth/setup"},
+		{path: "/api/auth/login"},
+		{path: "/api/health"},
+		{path: "/"},
+		{path: "/index.html"},
+		{path: "/_nuxt/entry.js"},
+		{path: "/favicon.ico"},
+		{path: "/api/auth/logout", auth: true},
+		{path: "/api/config", auth: true},
+		{path: "/api/scripts/1", auth: true},
+		{path: "/api/tokens", auth: true},
+		{path: "/api/events", auth: true},
+		{path: "/api/health/", auth: true},
+		{path: "/metrics", auth: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := requiresAuth(tt.path); got != tt.auth {
+				t.Errorf("requiresAuth = %v, want %v", got, tt.auth)
+			}
+		})
+	}
+}
+
+// newAuthTestProgram returns a program with one account, logged in with the
+// returned session cookie, and an API token.
+func newAuthTestProgram(t *testing.T) (p *program, session *http.Cookie, token string) {
+	t.Helper()
+	p, _ = newTestProgram(t, Config{BrokerAddress: "tcp://localhost:1883"})
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.db.CreateFirstUser(&User{Username: "admin", PasswordHash: hash}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	p.handleLogin(w, httptest.NewRequest("POST", "/api/auth/login", strings.NewReader(`{"username": "admin", "password": "correct horse"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("login returned %d: %s", w.Code, w.Body)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			session = cookie
+		}
+	}
+	if session == nil || !session.HttpOnly {
+		t.Fatalf("login set no HttpOnly session cookie: %v", w.Result().Cookies())
+	}
+
+	token = apiTokenPrefix + "test"
+	if err := p.db.CreateAPIToken(&APIToken{Name: "test", TokenHash: hashSecret(token)}); err != nil {
+		t.Fatal(err)
+	}
+	return p, session, token
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	p, session, token := newAuthTestProgram(t)
+	handler := p.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	expired := "expired-session"
+	if err := p.db.CreateSession(&Session{TokenHash: hashSecret(expired), UserID: 1, ExpiresAt: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	revoked := apiTokenPrefix + "revoked"
+	revokedToken := APIToken{Name: "revoked", TokenHash: hashSecret(revoked)}
+	if err := p.db.CreateAPIToken(&revokedToken); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.db.DeleteAPIToken(revokedToken.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		bearer string
+		cookie string
+		status int
+	}{
+		{name: "public route", path: "/api/auth/status", status: http.StatusOK},
+		{name: "health", path: "/api/health", status: http.StatusOK},
+		{name: "static asset", path: "/_nuxt/entry.js", status: http.StatusOK},
+		{name: "preflight", method: "OPTIONS", path: "/api/config", status: http.StatusOK},
+		{name: "no credentials", path: "/api/config", status: http.StatusUnauthorized},
+		{name: "metrics without credentials", path: "/metrics", status: http.StatusUnauthorized},
+		{name: "metrics with token", path: "/metrics", bearer: token, status: http.StatusOK},
+		{name: "bearer token", path: "/api/config", bearer: token, status: http.StatusOK},
+		{name: "session cookie", path: "/api/config", cookie: session.Value, status: http.StatusOK},
+		{name: "unknown token", path: "/api/config", bearer: apiTokenPrefix + "unknown", status: http.StatusUnauthorized},
+		{name: "revoked token", path: "/api/config", bearer: revoked, status: http.StatusUnauthorized},
+		{name: "unknown session", path: "/api/config", cookie: "unknown", status: http.StatusUnauthorized},
+		{name: "expired session", path: "/api/config", cookie: expired, status: http.StatusUnauthorized},
+		// An invalid bearer token isn't rescued by a valid cookie
+		{name: "invalid token with session", path: "/api/config", bearer: "unknown", cookie: session.Value, status: http.StatusUnauthorized},
+		{name: "access_token on the event stream", path: "/api/events?access_token=" + token, status: http.StatusOK},
+		{name: "access_token elsewhere", path: "/api/config?access_token=" + token, status: http.StatusUnauthorized},
+		{name: "session as access_token", path: "/api/events?access_token=" + session.Value, status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			r := httptest.NewRequest(method, tt.path, nil)
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestAuthRevocation(t *testing.T) {
+	p, session, token := newAuthTestProgram(t)
+	authenticated := func(r *http.Request) bool {
+		_, ok := p.authenticate(r)
+		return ok
+	}
+	withCookie := httptest.NewRequest("GET", "/api/config", nil)
+	withCookie.AddCookie(session)
+	withToken := httptest.NewRequest("GET", "/api/config", nil)
+	withToken.Header.Set("Authorization", "Bearer "+token)
+	if !authenticated(withCookie) || !authenticated(withToken) {
+		t.Fatal("the session or token isn't accepted before revoking it")
+	}
+
+	p.handleLogout(httptest.NewRecorder(), withCookie)
+	if authenticated(withCookie) {
+		t.Error("the session is still accepted after logging out")
+	}
+
+	tokens, err := p.db.GetAPITokens()
+	if err != nil || len(*tokens) != 1 {
+		t.Fatalf("tokens = %v, %v, want the test token", tokens, err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/tokens/{id}", p.handleDeleteToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/tokens/"+strconv.FormatInt((*tokens)[0].ID, 10), nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("deleting the token returned %d: %s", w.Code, w.Body)
+	}
+	if authenticated(withToken) {
+		t.Error("the token is still accepted after deleting it")
+	}
+}
+
+func TestHandleLogin(t *testing.T) {
+	p, _, _ := newAuthTestProgram(t)
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "valid", body: `{"username": "admin", "password": "correct horse"}`, status: http.StatusOK},
+		{name: "username with spaces", body: `{"username": " admin ", "password": "correct horse"}`, status: http.StatusOK},
+		{name: "wrong password", body: `{"username": "admin", "password": "wrong horse"}`, status: http.StatusUnauthorized},
+		{name: "unknown user", body: `{"username": "nobody", "password": "correct horse"}`, status: http.StatusUnauthorized},
+		{name: "invalid JSON", body: `{"username": `, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			p.handleLogin(w, httptest.NewRequest("POST", "/api/auth/login", strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			gotCookie := len(w.Result().Cookies()) > 0
+			if gotCookie != (tt.status == http.StatusOK) {
+				t.Errorf("session cookie set = %v, want it only for a successful login", gotCookie)
+			}
+		})
+	}
+}
+
+func TestSetupAllowed(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		setupToken string
+		token      string
+		allowed    bool
+	}{
+		{name: "IPv4 loopback", remoteAddr: "127.0.0.1:50000", allowed: true},
+		{name: "IPv6 loopback", remoteAddr: "[::1]:50000", allowed: true},
+		{name: "remote with token", remoteAddr: "192.168.1.20:50000", setupToken: "setup", token: "setup", allowed: true},
+		{name: "remote without token", remoteAddr: "192.168.1.20:50000", setupToken: "setup"},
+		{name: "remote with wrong token", remoteAddr: "192.168.1.20:50000", setupToken: "setup", token: "guess"},
+		{name: "remote once setup is done", remoteAddr: "192.168.1.20:50000"},
+		{name: "remote with empty token once setup is done", remoteAddr: "192.168.1.20:50000", token: ""},
+		{name: "invalid remote address", remoteAddr: "127.0.0.1", setupToken: "setup"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &program{setupToken: tt.setupToken}
+			r := httptest.NewRequest("POST", "/api/auth/setup", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if got := p.setupAllowed(r, tt.token); got != tt.allowed {
+				t.Errorf("setupAllowed = %v, want %v", got, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestHandleAuthSetupFromAnotherComputer(t *testing.T) {
+	p, _ := newTestProgram(t, Config{BrokerAddress: "tcp://localhost:1883"})
+	p.setupToken = "setup"
+	setup := func(body string) int {
+		r := httptest.NewRequest("POST", "/api/auth/setup", strings.NewReader(body))
+		r.RemoteAddr = "192.168.1.20:50000"
+		w := httptest.NewRecorder()
+		p.handleAuthSetup(w, r)
+		return w.Code
+	}
+
+	if status := setup(`{"username": "admin", "password": "correct horse"}`); status != http.StatusForbidden {
+		t.Fatalf("setup without the token returned %d, want %d", status, http.StatusForbidden)
+	}
+	if count, _ := p.db.CountUsers(); count != 0 {
+		t.Fatal("a rejected setup created an account")
+	}
+	if status := setup(`{"username": "admin", "password": "correct horse", "setup_token": "setup"}`); status != http.StatusCreated {
+		t.Fatalf("setup with the token returned %d, want %d", status, http.StatusCreated)
+	}
+	if status := setup(`{"username": "other", "password": "correct horse", "setup_token": "setup"}`); status != http.StatusConflict {
+		t.Errorf("a second setup returned %d, want %d", status, http.StatusConflict)
+	}
+}
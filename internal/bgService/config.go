@@ -3,6 +3,8 @@ package bgService
 import (
 	"fmt"
 	"win-sense-connect/internal/common"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 func (p *program) loadConfig(logger common.Logger) error {
@@ -12,7 +14,36 @@ func (p *program) loadConfig(logger common.Logger) error {
 		logger.Error(fmt.Sprintf("Failed to get config: %v", err))
 		return err
 	}
-	p.config = *conf
+	p.setConfig(*conf)
 	logger.Debug("Config loaded successfully")
 	return nil
 }
+
+// currentConfig returns the config as it is now. A reload replaces the config
+// instead of changing it, so the copy stays consistent while the caller uses
+// it. Its maps are shared and must not be modified.
+func (p *program) currentConfig() Config {
+	p.configMutex.RLock()
+	defer p.configMutex.RUnlock()
+	return p.config
+}
+
+func (p *program) setConfig(config Config) {
+	p.configMutex.Lock()
+	defer p.configMutex.Unlock()
+	p.config = config
+}
+
+// currentMQTTClient returns the MQTT client, which a reload replaces when the
+// connection settings change. It is nil until run has set it up.
+func (p *program) currentMQTTClient() mqtt.Client {
+	p.configMutex.RLock()
+	defer p.configMutex.RUnlock()
+	return p.mqttClient
+}
+
+func (p *program) setMQTTClient(client mqtt.Client) {
+	p.configMutex.Lock()
+	defer p.configMutex.Unlock()
+	p.mqttClient = client
+}
@@ -0,0 +1,154 @@
+package bgService
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"runtime/debug"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	discoveryPrefix     = "homeassistant"
+	discoveryComponent  = "button"
+	discoveryInvalidRef = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+)
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+type discoveryButton struct {
+	Name                string          `json:"name"`
+	UniqueID            string          `json:"unique_id"`
+	ObjectID            string          `json:"object_id"`
+	CommandTopic        string          `json:"command_topic"`
+	PayloadPress        string          `json:"payload_press"`
+	AvailabilityTopic   string          `json:"availability_topic"`
+	PayloadAvailable    string          `json:"payload_available"`
+	PayloadNotAvailable string          `json:"payload_not_available"`
+	Icon                string          `json:"icon,omitempty"`
+	Device              discoveryDevice `json:"device"`
+}
+
+// discoveryID turns a client id or command name into something Home Assistant
+// accepts as a node_id / object_id.
+func discoveryID(value string) string {
+	id := discoveryInvalidRef.ReplaceAllString(strings.TrimSpace(value), "_")
+	return strings.Trim(strings.ToLower(id), "_")
+}
+
+func (p *program) discoveryNodeID() string {
+	return discoveryID(p.currentConfig().ClientID)
+}
+
+func (p *program) discoveryTopic(command string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", discoveryPrefix, discoveryComponent, p.discoveryNodeID(), discoveryID(command))
+}
+
+func (p *program) discoveryConfig(command string) discoveryButton {
+	config := p.currentConfig()
+	nodeID := discoveryID(config.ClientID)
+	return discoveryButton{
+		Name:                command,
+		UniqueID:            "winsense_" + nodeID + "_" + discoveryID(command),
+		ObjectID:            nodeID + "_" + discoveryID(command),
+		CommandTopic:        commandTopic(config),
+		PayloadPress:        command,
+		AvailabilityTopic:   statusTopic(config),
+		PayloadAvailable:    p.payloadOnline(),
+		PayloadNotAvailable: p.payloadOffline(),
+		Icon:                "mdi:script-text-play",
+		Device: discoveryDevice{
+			Identifiers:  []string{"winsense_" + nodeID},
+			Name:         config.ClientID,
+			Manufacturer: "WinSenseConnect",
+			Model:        "WinSenseConnect",
+		},
+	}
+}
+
+// publishDiscovery publishes a retained Home Assistant button config for every
+// registered command, grouped under a single device for this PC.
+func (p *program) publishDiscovery(client mqtt.Client) {
+	for command := range p.currentConfig().Commands {
+		payload, err := json.Marshal(p.discoveryConfig(command))
+		if err != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to marshal discovery config for command '%s': %v", command, err))
+			continue
+		}
+
+		topic := p.discoveryTopic(command)
+		if token := client.Publish(topic, 0, true, payload); token.Wait() && token.Error() != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to publish discovery config for command '%s': %v", command, token.Error()))
+		} else {
+			p.Logger.Debug(fmt.Sprintf("Published discovery config for command '%s' to %s", command, topic))
+		}
+	}
+}
+
+// removeDiscovery clears the retained discovery config for a command so Home
+// Assistant drops the entity.
+func (p *program) removeDiscovery(client mqtt.Client, command string) {
+	topic := p.discoveryTopic(command)
+	if token := client.Publish(topic, 0, true, []byte{}); token.Wait() && token.Error() != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to remove discovery config for command '%s': %v", command, token.Error()))
+	} else {
+		p.Logger.Debug(fmt.Sprintf("Removed discovery config for command '%s'", command))
+	}
+}
+
+// clearDiscovery removes the discovery configs of every command, for when the
+// service moves to another node id. Nothing would ever remove the old ones.
+func (p *program) clearDiscovery(client mqtt.Client) {
+	if !client.IsConnectionOpen() {
+		return
+	}
+	for command := range p.currentConfig().Commands {
+		p.removeDiscovery(client, command)
+	}
+}
+
+// subscribeDiscovery listens to the retained discovery configs of this node so
+// that entities belonging to scripts which have since been deleted get removed,
+// even if the deletion happened while the service was not running.
+func (p *program) subscribeDiscovery(client mqtt.Client) {
+	topic := fmt.Sprintf("%s/%s/%s/+/config", discoveryPrefix, discoveryComponent, p.discoveryNodeID())
+	if token := client.Subscribe(topic, 0, p.discoveryHandler); token.Wait() && token.Error() != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to subscribe to discovery topic: %v", token.Error()))
+	} else {
+		p.Logger.Debug(fmt.Sprintf("Successfully subscribed to discovery topic: %s", topic))
+	}
+}
+
+func (p *program) discoveryHandler(client mqtt.Client, msg mqtt.Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.Logger.Error(fmt.Sprintf("Recovered from panic in discoveryHandler: %v\nStack trace: %s", r, debug.Stack()))
+		}
+	}()
+
+	if len(msg.Payload()) == 0 {
+		return
+	}
+
+	var button discoveryButton
+	if err := json.Unmarshal(msg.Payload(), &button); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse discovery config on %s: %v", msg.Topic(), err))
+		return
+	}
+
+	if _, exists := p.currentConfig().Commands[button.PayloadPress]; exists && msg.Topic() == p.discoveryTopic(button.PayloadPress) {
+		return
+	}
+
+	p.Logger.Debug(fmt.Sprintf("Removing stale discovery config on %s", msg.Topic()))
+	if token := client.Publish(msg.Topic(), 0, true, []byte{}); token.Wait() && token.Error() != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to remove stale discovery config on %s: %v", msg.Topic(), token.Error()))
+	}
+}
@@ -0,0 +1,102 @@
+package bgService
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiscoveryID(t *testing.T) {
+	tests := []struct {
+		value string
+		id    string
+	}{
+		{value: "lock_screen", id: "lock_screen"},
+		{value: "Lock PC", id: "lock_pc"},
+		{value: "lock-pc", id: "lock-pc"},
+		{value: "  Office PC  ", id: "office_pc"},
+		{value: "volume up!!", id: "volume_up"},
+		{value: "__shutdown__", id: "shutdown"},
+		{value: "café.ps1", id: "caf_ps1"},
+	}
+	for _, tt := range tests {
+		if id := discoveryID(tt.value); id != tt.id {
+			t.Errorf("discoveryID(%q) = %q, want %q", tt.value, id, tt.id)
+		}
+	}
+}
+
+func TestDiscoveryConfig(t *testing.T) {
+	p := &program{}
+	p.config.ClientID = "Office PC"
+	p.config.Topic = "home"
+
+	if topic, want := p.discoveryTopic("Lock Screen"), "homeassistant/button/office_pc/lock_screen/config"; topic != want {
+		t.Errorf("topic = %q, want %q", topic, want)
+	}
+
+	button := p.discoveryConfig("Lock Screen")
+	want := discoveryButton{
+		Name:                "Lock Screen",
+		UniqueID:            "winsense_office_pc_lock_screen",
+		ObjectID:            "office_pc_lock_screen",
+		CommandTopic:        "winsense/home/Office PC",
+		PayloadPress:        "Lock Screen",
+		AvailabilityTopic:   "winsense/home/Office PC/status",
+		PayloadAvailable:    "online",
+		PayloadNotAvailable: "offline",
+		Icon:                "mdi:script-text-play",
+		Device: discoveryDevice{
+			Identifiers:  []string{"winsense_office_pc"},
+			Name:         "Office PC",
+			Manufacturer: "WinSenseConnect",
+			Model:        "WinSenseConnect",
+		},
+	}
+	if !reflect.DeepEqual(button, want) {
+		t.Errorf("config = %+v, want %+v", button, want)
+	}
+
+	// Home Assistant reads these keys from the retained payload
+	payload, err := json.Marshal(button)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"name", "unique_id", "object_id", "command_topic", "payload_press", "availability_topic", "device"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("payload has no %q key: %s", key, payload)
+		}
+	}
+}
+
+func TestClearDiscovery(t *testing.T) {
+	p, client := newTestProgram(t, Config{BrokerAddress: "tcp://localhost:1883", ClientID: "Office PC", Topic: "home"})
+	for _, name := range []string{"Lock PC", "backup"} {
+		if err := p.db.CreateScriptConfig(&ScriptConfig{Name: name, ScriptPath: name + ".sh", Concurrency: concurrencyParallel}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.loadConfig(p.Logger); err != nil {
+		t.Fatal(err)
+	}
+
+	p.clearDiscovery(client)
+	cleared := map[string]bool{}
+	for _, message := range client.messages() {
+		if message.payload != "" || !message.retained {
+			t.Errorf("published %q to %s, want an empty retained message", message.payload, message.topic)
+		}
+		cleared[message.topic] = true
+	}
+	want := map[string]bool{
+		"homeassistant/button/office_pc/lock_pc/config": true,
+		"homeassistant/button/office_pc/backup/config":  true,
+	}
+	if !reflect.DeepEqual(cleared, want) {
+		t.Errorf("cleared %v, want %v", cleared, want)
+	}
+}
@@ -0,0 +1,145 @@
+//go:build !windows
+
+package bgService
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/shirou/gopsutil/v4/host"
+)
+
+// runAsLoggedInUser runs the script with the credentials of the first user with
+// an active login session, the closest equivalent of the active WTS session on
+// Windows. The service has to run as root for the setuid to succeed.
+func (p *program) runAsLoggedInUser(ctx context.Context, name string, cmdArgs []string, args scriptArgs) (scriptResult, error) {
+	loggedInUser, err := getLoggedInUser()
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("failed to get logged in user: %v", err))
+		return scriptResult{}, fmt.Errorf("failed to get logged in user: %v", err)
+	}
+
+	credential, err := userCredential(loggedInUser)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("failed to get user credentials: %v", err))
+		return scriptResult{}, fmt.Errorf("failed to get user credentials: %v", err)
+	}
+
+	cmd := exec.CommandContext(ctx, name, cmdArgs...)
+	cmd.Env = args.Environ(userEnviron(loggedInUser))
+	cmd.Dir = loggedInUser.HomeDir
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: credential,
+		Setpgid:    true,
+	}
+
+	return p.runCommand(ctx, cmd)
+}
+
+func (p *program) runAsLocalSystem(ctx context.Context, name string, cmdArgs []string, args scriptArgs) (scriptResult, error) {
+	cmd := exec.CommandContext(ctx, name, cmdArgs...)
+	cmd.Env = args.Environ(os.Environ())
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
+	return p.runCommand(ctx, cmd)
+}
+
+// userPath is the PATH scripts run as a user get, the default of a login shell.
+const userPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// userEnviron returns the environment for a script run as u. It starts from
+// scratch instead of the service's environment, which belongs to root and may
+// hold its credentials. The session's runtime directory and D-Bus socket are
+// passed on when they exist, so scripts can reach the desktop session.
+func userEnviron(u *user.User) []string {
+	env := []string{
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"LOGNAME=" + u.Username,
+		"SHELL=/bin/sh",
+		"PATH=" + userPath,
+	}
+	if lang, ok := os.LookupEnv("LANG"); ok {
+		env = append(env, "LANG="+lang)
+	}
+	runtimeDir := "/run/user/" + u.Uid
+	if _, err := os.Stat(runtimeDir); err == nil {
+		env = append(env, "XDG_RUNTIME_DIR="+runtimeDir)
+		if _, err := os.Stat(runtimeDir + "/bus"); err == nil {
+			env = append(env, "DBUS_SESSION_BUS_ADDRESS=unix:path="+runtimeDir+"/bus")
+		}
+	}
+	return env
+}
+
+// shellPath prefers bash for .sh scripts, since most of them use bash-isms, and
+// falls back to the POSIX shell.
+func shellPath() string {
+	if path, err := exec.LookPath("bash"); err == nil {
+		return path
+	}
+	return "/bin/sh"
+}
+
+func getLoggedInUser() (*user.User, error) {
+	users, err := host.Users()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list logged in users: %v", err)
+	}
+	for _, u := range users {
+		if u.User == "" || u.User == "root" {
+			continue
+		}
+		return user.Lookup(u.User)
+	}
+	return nil, fmt.Errorf("no logged in user found")
+}
+
+func userCredential(u *user.User) (*syscall.Credential, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid %s: %v", u.Uid, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid %s: %v", u.Gid, err)
+	}
+
+	credential := &syscall.Credential{
+		Uid: uint32(uid),
+		Gid: uint32(gid),
+	}
+	groupIDs, err := u.GroupIds()
+	if err == nil {
+		for _, groupID := range groupIDs {
+			if g, err := strconv.ParseUint(groupID, 10, 32); err == nil {
+				credential.Groups = append(credential.Groups, uint32(g))
+			}
+		}
+	}
+	return credential, nil
+}
+
+// killProcessTree terminates a process and all of its children. Scripts are
+// started in their own process group, so signalling the group reaches every
+// child they spawned.
+func killProcessTree(process *os.Process) error {
+	if process == nil {
+		return nil
+	}
+
+	if err := syscall.Kill(-process.Pid, syscall.SIGKILL); err != nil {
+		// Fall back to killing at least the direct child
+		if killErr := process.Kill(); killErr != nil {
+			return fmt.Errorf("failed to kill process tree: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+//go:build !windows
+
+package bgService
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"os/user"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunCommandKillsProcessGroupOnTimeout(t *testing.T) {
+	p := &program{Logger: discardLogger{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// The background sleep keeps the output pipe open, so the command only
+	// returns before WaitDelay if the whole process group was killed
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", "sleep 30 & echo started; wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	start := time.Now()
+	result, err := p.runCommand(ctx, cmd)
+	if !errors.Is(err, errScriptTimeout) {
+		t.Fatalf("err = %v, want %v", err, errScriptTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("command returned after %s, the child outlived the timeout", elapsed)
+	}
+	if result.Stdout != "started\n" {
+		t.Errorf("stdout = %q, want the output written before the timeout", result.Stdout)
+	}
+}
+
+func TestRunCommandExitCode(t *testing.T) {
+	p := &program{Logger: discardLogger{}}
+	cmd := exec.CommandContext(context.Background(), "/bin/sh", "-c", "echo out; echo err >&2; exit 3")
+
+	result, err := p.runCommand(context.Background(), cmd)
+	if err == nil {
+		t.Fatal("a failing command returned no error")
+	}
+	if result.ExitCode != 3 || result.Stdout != "out\n" || result.Stderr != "err\n" {
+		t.Errorf("result = %+v, want exit code 3 with both outputs", result)
+	}
+}
+
+func TestUserEnviron(t *testing.T) {
+	t.Setenv("WINSENSE_TEST_SECRET", "root only")
+	u := &user.User{Uid: "4242", Gid: "4242", Username: "alice", HomeDir: "/home/alice"}
+
+	env := userEnviron(u)
+	vars := map[string]string{}
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		vars[name] = value
+	}
+	for name, want := range map[string]string{"HOME": "/home/alice", "USER": "alice", "LOGNAME": "alice", "PATH": userPath} {
+		if vars[name] != want {
+			t.Errorf("%s = %q, want %q", name, vars[name], want)
+		}
+	}
+	if _, ok := vars["WINSENSE_TEST_SECRET"]; ok {
+		t.Error("the service's environment was passed to the user's script")
+	}
+	if _, ok := vars["XDG_RUNTIME_DIR"]; ok {
+		t.Error("XDG_RUNTIME_DIR is set for a user without a runtime directory")
+	}
+}
@@ -0,0 +1,75 @@
+package bgService
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+func (p *program) runAsLoggedInUser(ctx context.Context, name string, cmdArgs []string, args scriptArgs) (scriptResult, error) {
+	sessionID, err := getActiveSessionID()
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("failed to get active session ID: %v", err))
+		return scriptResult{}, fmt.Errorf("failed to get active session ID: %v", err)
+	}
+
+	var userToken windows.Token
+	err = wtsQueryUserToken(sessionID, &userToken)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("failed to get user token: %v", err))
+		return scriptResult{}, fmt.Errorf("failed to get user token: %v", err)
+	}
+	defer userToken.Close()
+
+	// Start from the user's own environment, not the service's, so the script
+	// gets the user's profile, APPDATA and TEMP
+	env, err := userToken.Environ(false)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("failed to get user environment: %v", err))
+		return scriptResult{}, fmt.Errorf("failed to get user environment: %v", err)
+	}
+
+	cmd := exec.CommandContext(ctx, name, cmdArgs...)
+	cmd.Env = args.Environ(env)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Token:         syscall.Token(userToken),
+		CreationFlags: windows.CREATE_NO_WINDOW,
+	}
+
+	return p.runCommand(ctx, cmd)
+}
+
+func (p *program) runAsLocalSystem(ctx context.Context, name string, cmdArgs []string, args scriptArgs) (scriptResult, error) {
+	cmd := exec.CommandContext(ctx, name, cmdArgs...)
+	cmd.Env = args.Environ(os.Environ())
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: windows.CREATE_NO_WINDOW,
+	}
+
+	return p.runCommand(ctx, cmd)
+}
+
+// killProcessTree terminates a process and all of its children. taskkill is
+// used because Process.Kill only terminates the direct child.
+func killProcessTree(process *os.Process) error {
+	if process == nil {
+		return nil
+	}
+
+	cmd := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(process.Pid))
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: windows.CREATE_NO_WINDOW,
+	}
+	if err := cmd.Run(); err != nil {
+		// Fall back to killing at least the direct child
+		if killErr := process.Kill(); killErr != nil {
+			return fmt.Errorf("failed to kill process tree: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package bgService
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Concurrency policies for a command that is triggered while a previous run of
+// it is still in progress
+const (
+	concurrencyParallel = "parallel"
+	concurrencyQueue    = "queue"
+	concurrencyDrop     = "drop"
+	concurrencyReplace  = "replace"
+)
+
+var (
+	errCommandBusy  = errors.New("command is already running")
+	errRunCancelled = errors.New("run cancelled")
+)
+
+func validConcurrency(policy string) bool {
+	switch policy {
+	case "", concurrencyParallel, concurrencyQueue, concurrencyDrop, concurrencyReplace:
+		return true
+	}
+	return false
+}
+
+// scriptExecutor decides when a script run may start. It applies the
+// per-command concurrency policy and the global limit on concurrently running
+// scripts. Runs that can't start yet wait in acquire and count as queued.
+type scriptExecutor struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    func() int
+	nextID   uint64
+	running  int
+	queued   int
+	commands map[string]*commandState
+	// runs holds the cancel function of every queued or running script run
+	runs map[*ScriptRun]context.CancelFunc
+}
+
+type commandState struct {
+	running map[uint64]context.CancelFunc
+	// waiters holds the queue policy runs in arrival order
+	waiters []uint64
+	queued  int
+	// replaceID is the most recent run that asked to replace the others
+	replaceID uint64
+}
+
+type executorStatus struct {
+	MaxConcurrent int                      `json:"max_concurrent_scripts"`
+	Running       int                      `json:"running"`
+	Queued        int                      `json:"queued"`
+	Commands      map[string]commandStatus `json:"commands"`
+}
+
+type commandStatus struct {
+	Running int `json:"running"`
+	Queued  int `json:"queued"`
+}
+
+// newScriptExecutor creates an executor. limit is read on every acquire so a
+// config reload applies immediately; zero or less means no limit.
+func newScriptExecutor(limit func() int) *scriptExecutor {
+	e := &scriptExecutor{
+		limit:    limit,
+		commands: make(map[string]*commandState),
+		runs:     make(map[*ScriptRun]context.CancelFunc),
+	}
+	e.cond = sync.NewCond(&e.mu)
+	return e
+}
+
+// acquire blocks until a run of command may start under policy, or returns
+// errCommandBusy or errRunCancelled when it may not run at all. cancel aborts
+// the run and is called when a later run replaces it. The returned release
+// function must be called once the run has finished.
+func (e *scriptExecutor) acquire(ctx context.Context, command string, policy string, cancel context.CancelFunc) (func(), error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	state := e.command(command)
+	e.nextID++
+	id := e.nextID
+
+	switch policy {
+	case concurrencyDrop:
+		if len(state.running) > 0 || state.queued > 0 {
+			e.cleanup(command, state)
+			return nil, errCommandBusy
+		}
+	case concurrencyReplace:
+		for _, cancelRunning := range state.running {
+			cancelRunning()
+		}
+		state.replaceID = id
+		// Let the runs still waiting see that they were replaced
+		e.cond.Broadcast()
+	case concurrencyQueue:
+		state.waiters = append(state.waiters, id)
+	}
+
+	// Wake up the wait loop when ctx is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		e.mu.Lock()
+		e.cond.Broadcast()
+		e.mu.Unlock()
+	})
+	defer stop()
+
+	state.queued++
+	e.queued++
+	var err error
+	for {
+		if ctx.Err() != nil {
+			err = errRunCancelled
+			break
+		}
+		if policy == concurrencyReplace && state.replaceID != id {
+			// A newer run replaced this one before it started
+			err = errRunCancelled
+			break
+		}
+		if e.ready(state, policy, id) {
+			break
+		}
+		e.cond.Wait()
+	}
+	state.queued--
+	e.queued--
+	if policy == concurrencyQueue {
+		state.removeWaiter(id)
+	}
+
+	if err != nil {
+		// Removing a waiter may let the next one start
+		e.cond.Broadcast()
+		e.cleanup(command, state)
+		return nil, err
+	}
+
+	state.running[id] = cancel
+	e.running++
+
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(state.running, id)
+		e.running--
+		e.cleanup(command, state)
+		e.cond.Broadcast()
+	}, nil
+}
+
+func (e *scriptExecutor) ready(state *commandState, policy string, id uint64) bool {
+	if limit := e.limit(); limit > 0 && e.running >= limit {
+		return false
+	}
+	switch policy {
+	case concurrencyQueue:
+		return len(state.running) == 0 && len(state.waiters) > 0 && state.waiters[0] == id
+	case concurrencyDrop, concurrencyReplace:
+		return len(state.running) == 0
+	}
+	return true
+}
+
+func (e *scriptExecutor) command(command string) *commandState {
+	state, ok := e.commands[command]
+	if !ok {
+		state = &commandState{running: make(map[uint64]context.CancelFunc)}
+		e.commands[command] = state
+	}
+	return state
+}
+
+// cleanup forgets idle commands so the map doesn't grow with every command
+// that was ever run.
+func (e *scriptExecutor) cleanup(command string, state *commandState) {
+	if len(state.running) == 0 && state.queued == 0 && len(state.waiters) == 0 {
+		delete(e.commands, command)
+	}
+}
+
+func (s *commandState) removeWaiter(id uint64) {
+	for i, waiter := range s.waiters {
+		if waiter == id {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// track makes run cancellable through cancelRuns until the returned function is
+// called.
+func (e *scriptExecutor) track(run *ScriptRun, cancel context.CancelFunc) func() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.runs[run] = cancel
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.runs, run)
+	}
+}
+
+// cancelRuns cancels every queued or running run that match selects and
+// returns how many were cancelled. Only the run's ID, Command and RequestID may
+// be read by match, the rest is owned by the goroutine executing it.
+func (e *scriptExecutor) cancelRuns(match func(run *ScriptRun) bool) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	cancelled := 0
+	for run, cancel := range e.runs {
+		if match(run) {
+			cancel()
+			cancelled++
+		}
+	}
+	return cancelled
+}
+
+// Status reports how many runs are in progress and waiting, overall and per
+// command.
+func (e *scriptExecutor) Status() executorStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	status := executorStatus{
+		MaxConcurrent: e.limit(),
+		Running:       e.running,
+		Queued:        e.queued,
+		Commands:      make(map[string]commandStatus),
+	}
+	for command, state := range e.commands {
+		status.Commands[command] = commandStatus{
+			Running: len(state.running),
+			Queued:  state.queued,
+		}
+	}
+	return status
+}
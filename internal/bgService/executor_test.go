@@ -0,0 +1,200 @@
+package bgService
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitForQueued waits until the executor reports queued waiting runs.
+func waitForQueued(t *testing.T, e *scriptExecutor, queued int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for e.Status().Queued != queued {
+		if time.Now().After(deadline) {
+			t.Fatalf("queued = %d, want %d", e.Status().Queued, queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type acquireResult struct {
+	release func()
+	err     error
+}
+
+func acquireAsync(e *scriptExecutor, ctx context.Context, command, policy string, cancel context.CancelFunc) chan acquireResult {
+	result := make(chan acquireResult, 1)
+	go func() {
+		release, err := e.acquire(ctx, command, policy, cancel)
+		result <- acquireResult{release, err}
+	}()
+	return result
+}
+
+func TestExecutorPolicyWhileRunning(t *testing.T) {
+	tests := []struct {
+		policy string
+		// waits is true when the second run has to wait for the first
+		waits bool
+		err   error
+		// cancelsFirst is true when the second run cancels the first
+		cancelsFirst bool
+	}{
+		{policy: concurrencyParallel},
+		{policy: ""},
+		{policy: concurrencyDrop, err: errCommandBusy},
+		{policy: concurrencyQueue, waits: true},
+		{policy: concurrencyReplace, waits: true, cancelsFirst: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			e := newScriptExecutor(func() int { return 0 })
+			firstCancelled := false
+			release, err := e.acquire(context.Background(), "cmd", tt.policy, func() { firstCancelled = true })
+			if err != nil {
+				t.Fatalf("first acquire: %v", err)
+			}
+
+			second := acquireAsync(e, context.Background(), "cmd", tt.policy, func() {})
+			if tt.waits {
+				waitForQueued(t, e, 1)
+				select {
+				case <-second:
+					t.Fatal("second run started while the first was running")
+				case <-time.After(10 * time.Millisecond):
+				}
+				release()
+			}
+			result := <-second
+			if !errors.Is(result.err, tt.err) {
+				t.Fatalf("second acquire: err = %v, want %v", result.err, tt.err)
+			}
+			if result.release != nil {
+				result.release()
+			}
+			if !tt.waits {
+				release()
+			}
+			if firstCancelled != tt.cancelsFirst {
+				t.Errorf("first cancelled = %v, want %v", firstCancelled, tt.cancelsFirst)
+			}
+			if status := e.Status(); status.Running != 0 || status.Queued != 0 || len(status.Commands) != 0 {
+				t.Errorf("status after release = %+v, want idle", status)
+			}
+		})
+	}
+}
+
+func TestExecutorQueueOrder(t *testing.T) {
+	e := newScriptExecutor(func() int { return 0 })
+	release, err := e.acquire(context.Background(), "cmd", concurrencyQueue, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var waiting []chan acquireResult
+	for i := 0; i < 3; i++ {
+		waiting = append(waiting, acquireAsync(e, context.Background(), "cmd", concurrencyQueue, func() {}))
+		waitForQueued(t, e, i+1)
+	}
+	for i, result := range waiting {
+		release()
+		r := <-result
+		if r.err != nil {
+			t.Fatalf("run %d: %v", i, r.err)
+		}
+		if queued := e.Status().Queued; queued != len(waiting)-i-1 {
+			t.Fatalf("after run %d started queued = %d, want %d", i, queued, len(waiting)-i-1)
+		}
+		release = r.release
+	}
+	release()
+}
+
+func TestExecutorReplaceCancelsQueued(t *testing.T) {
+	e := newScriptExecutor(func() int { return 0 })
+	release, err := e.acquire(context.Background(), "cmd", concurrencyReplace, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := acquireAsync(e, context.Background(), "cmd", concurrencyReplace, func() {})
+	waitForQueued(t, e, 1)
+	third := acquireAsync(e, context.Background(), "cmd", concurrencyReplace, func() {})
+	if r := <-second; !errors.Is(r.err, errRunCancelled) {
+		t.Fatalf("replaced waiting run: err = %v, want %v", r.err, errRunCancelled)
+	}
+	release()
+	r := <-third
+	if r.err != nil {
+		t.Fatalf("newest run: %v", r.err)
+	}
+	r.release()
+}
+
+func TestExecutorGlobalLimit(t *testing.T) {
+	e := newScriptExecutor(func() int { return 1 })
+	release, err := e.acquire(context.Background(), "a", concurrencyParallel, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := acquireAsync(e, context.Background(), "b", concurrencyParallel, func() {})
+	waitForQueued(t, e, 1)
+	release()
+	r := <-other
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	r.release()
+}
+
+func TestExecutorCancelWhileQueued(t *testing.T) {
+	e := newScriptExecutor(func() int { return 0 })
+	release, err := e.acquire(context.Background(), "cmd", concurrencyQueue, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := acquireAsync(e, ctx, "cmd", concurrencyQueue, cancel)
+	waitForQueued(t, e, 1)
+	cancel()
+	if r := <-waiting; !errors.Is(r.err, errRunCancelled) {
+		t.Fatalf("err = %v, want %v", r.err, errRunCancelled)
+	}
+	if queued := e.Status().Queued; queued != 0 {
+		t.Errorf("queued = %d, want 0", queued)
+	}
+}
+
+func TestExecutorCancelRuns(t *testing.T) {
+	e := newScriptExecutor(func() int { return 0 })
+	cancelled := map[string]bool{}
+	runs := []*ScriptRun{
+		{ID: 1, Command: "backup", RequestID: "a"},
+		{ID: 2, Command: "backup", RequestID: "b"},
+		{ID: 3, Command: "lock", RequestID: "c"},
+	}
+	var untrack []func()
+	for _, run := range runs {
+		requestID := run.RequestID
+		untrack = append(untrack, e.track(run, func() { cancelled[requestID] = true }))
+	}
+
+	if n := e.cancelRuns(func(run *ScriptRun) bool { return run.Command == "backup" }); n != 2 {
+		t.Errorf("cancelled %d runs, want 2", n)
+	}
+	if !cancelled["a"] || !cancelled["b"] || cancelled["c"] {
+		t.Errorf("cancelled = %v, want the backup runs only", cancelled)
+	}
+
+	// Finished runs can't be cancelled any more
+	untrack[2]()
+	if n := e.cancelRuns(func(run *ScriptRun) bool { return run.RequestID == "c" }); n != 0 {
+		t.Errorf("cancelled %d finished runs", n)
+	}
+}
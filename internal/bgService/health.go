@@ -0,0 +1,184 @@
+package bgService
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Version is the release version. It is set at build time with
+// -ldflags "-X win-sense-connect/internal/bgService.Version=1.2.3".
+var Version = "dev"
+
+// Component states reported by /api/health and /api/status
+const (
+	componentOK      = "ok"
+	componentError   = "error"
+	componentStopped = "stopped"
+)
+
+// dbPingTimeout bounds the database check so a locked database doesn't hang the
+// health endpoint.
+const dbPingTimeout = 2 * time.Second
+
+// mqttState records what happened to the broker connection, so it can be
+// reported instead of only being logged.
+type mqttState struct {
+	mu               sync.Mutex
+	lastConnectAt    time.Time
+	lastDisconnectAt time.Time
+	lastError        string
+	lastErrorAt      time.Time
+}
+
+func (s *mqttState) connected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastConnectAt = time.Now()
+}
+
+func (s *mqttState) lost(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastDisconnectAt = time.Now()
+	s.setError(err)
+}
+
+func (s *mqttState) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setError(err)
+}
+
+func (s *mqttState) setError(err error) {
+	if err == nil {
+		return
+	}
+	s.lastError = err.Error()
+	s.lastErrorAt = time.Now()
+}
+
+type componentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type mqttStatus struct {
+	Status           string    `json:"status"`
+	Connected        bool      `json:"connected"`
+	Broker           string    `json:"broker"`
+	LastConnectAt    time.Time `json:"last_connect_at"`
+	LastDisconnectAt time.Time `json:"last_disconnect_at"`
+	LastError        string    `json:"last_error,omitempty"`
+	LastErrorAt      time.Time `json:"last_error_at"`
+}
+
+type workerStatus struct {
+	Status string `json:"status"`
+	Active int    `json:"active"`
+}
+
+type serviceStatus struct {
+	Status    string          `json:"status"`
+	Version   string          `json:"version"`
+	StartedAt time.Time       `json:"started_at"`
+	Uptime    int64           `json:"uptime"`
+	MQTT      mqttStatus      `json:"mqtt"`
+	Database  componentStatus `json:"database"`
+	Scripts   componentStatus `json:"scripts"`
+	Sensors   workerStatus    `json:"sensors"`
+	Schedules workerStatus    `json:"schedules"`
+	Rules     workerStatus    `json:"rules"`
+	Queue     executorStatus  `json:"queue"`
+}
+
+type healthStatus struct {
+	Status     string            `json:"status"`
+	Components map[string]string `json:"components"`
+}
+
+func (p *program) mqttStatus() mqttStatus {
+	p.mqttState.mu.Lock()
+	defer p.mqttState.mu.Unlock()
+
+	status := mqttStatus{
+		Status:           componentError,
+		Broker:           p.currentConfig().BrokerAddress,
+		LastConnectAt:    p.mqttState.lastConnectAt,
+		LastDisconnectAt: p.mqttState.lastDisconnectAt,
+		LastError:        p.mqttState.lastError,
+		LastErrorAt:      p.mqttState.lastErrorAt,
+	}
+	if client := p.currentMQTTClient(); client != nil && client.IsConnected() {
+		status.Status = componentOK
+		status.Connected = true
+	}
+	return status
+}
+
+func (p *program) databaseStatus() componentStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), dbPingTimeout)
+	defer cancel()
+	if err := p.db.PingContext(ctx); err != nil {
+		return componentStatus{Status: componentError, Error: err.Error()}
+	}
+	return componentStatus{Status: componentOK}
+}
+
+func (p *program) scriptDirStatus() componentStatus {
+	if _, err := os.ReadDir(p.scriptDir); err != nil {
+		return componentStatus{Status: componentError, Error: fmt.Sprintf("scripts directory is not readable: %v", err)}
+	}
+	return componentStatus{Status: componentOK}
+}
+
+// newWorkerStatus reports a scheduler that run() starts. active is only called
+// when the scheduler exists.
+func newWorkerStatus(started bool, active func() int) workerStatus {
+	if !started {
+		return workerStatus{Status: componentStopped}
+	}
+	return workerStatus{Status: componentOK, Active: active()}
+}
+
+// serviceStatus checks every component. The service is ok when the broker,
+// database and scripts directory all are.
+func (p *program) serviceStatus() serviceStatus {
+	status := serviceStatus{
+		Version:   Version,
+		StartedAt: p.startedAt,
+		Uptime:    int64(time.Since(p.startedAt).Seconds()),
+		MQTT:      p.mqttStatus(),
+		Database:  p.databaseStatus(),
+		Scripts:   p.scriptDirStatus(),
+		Sensors:   newWorkerStatus(p.sensors != nil, func() int { return p.sensors.Active() }),
+		Schedules: newWorkerStatus(p.schedules != nil, func() int { return p.schedules.Active() }),
+		Rules:     newWorkerStatus(p.rules != nil, func() int { return p.rules.Active() }),
+		Queue:     p.executor.Status(),
+	}
+
+	status.Status = componentOK
+	for _, component := range []string{status.MQTT.Status, status.Database.Status, status.Scripts.Status} {
+		if component != componentOK {
+			status.Status = componentError
+		}
+	}
+	return status
+}
+
+// health summarizes serviceStatus to one state per component.
+func (s serviceStatus) health() healthStatus {
+	return healthStatus{
+		Status: s.Status,
+		Components: map[string]string{
+			"mqtt":      s.MQTT.Status,
+			"database":  s.Database.Status,
+			"scripts":   s.Scripts.Status,
+			"sensors":   s.Sensors.Status,
+			"schedules": s.Schedules.Status,
+			"rules":     s.Rules.Status,
+		},
+	}
+}
@@ -0,0 +1,69 @@
+package bgService
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// disconnectedClient is a fakeClient that lost its broker connection.
+type disconnectedClient struct {
+	fakeClient
+}
+
+func (c *disconnectedClient) IsConnected() bool { return false }
+
+func TestServiceStatusHealth(t *testing.T) {
+	tests := []struct {
+		name string
+		fail func(p *program)
+		down string
+	}{
+		{name: "all ok"},
+		{name: "MQTT disconnected", fail: func(p *program) { p.setMQTTClient(&disconnectedClient{}) }, down: "mqtt"},
+		{name: "MQTT not set up", fail: func(p *program) { p.setMQTTClient(nil) }, down: "mqtt"},
+		{name: "database closed", fail: func(p *program) { p.db.Close() }, down: "database"},
+		{name: "scripts directory missing", fail: func(p *program) { p.scriptDir = filepath.Join(p.scriptDir, "missing") }, down: "scripts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProgram(t, Config{BrokerAddress: "tcp://localhost:1883"})
+			if tt.fail != nil {
+				tt.fail(p)
+			}
+
+			health := p.serviceStatus().health()
+			wantStatus := componentOK
+			if tt.down != "" {
+				wantStatus = componentError
+			}
+			if health.Status != wantStatus {
+				t.Errorf("status = %q, want %q", health.Status, wantStatus)
+			}
+			for component, status := range health.Components {
+				want := componentOK
+				switch {
+				case component == tt.down:
+					want = componentError
+				case component == "sensors" || component == "schedules" || component == "rules":
+					// run() didn't start them
+					want = componentStopped
+				}
+				if status != want {
+					t.Errorf("%s = %q, want %q", component, status, want)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			p.handleGetHealth(w, httptest.NewRequest("GET", "/api/health", nil))
+			wantCode := http.StatusOK
+			if tt.down != "" {
+				wantCode = http.StatusServiceUnavailable
+			}
+			if w.Code != wantCode {
+				t.Errorf("/api/health returned %d, want %d", w.Code, wantCode)
+			}
+		})
+	}
+}
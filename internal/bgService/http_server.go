@@ -1,17 +1,29 @@
 package bgService
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// httpShutdownTimeout is how long requests in progress may take when the HTTP
+// server restarts.
+const httpShutdownTimeout = 5 * time.Second
+
 func (p *program) startHTTPServer() {
 	p.Logger.Debug("Starting HTTP server")
 	r := p.router
@@ -22,35 +34,144 @@ func (p *program) startHTTPServer() {
 	}
 	staticPath := filepath.Join(filepath.Dir(exePath), "frontend/.output/public")
 
+	// Every /api route except the login ones requires a session or API token
+	r.Use(p.authMiddleware)
+
 	// API endpoints
+	r.HandleFunc("/api/auth/status", p.handleAuthStatus).Methods("GET")
+	r.HandleFunc("/api/auth/setup", p.handleAuthSetup).Methods("POST")
+	r.HandleFunc("/api/auth/login", p.handleLogin).Methods("POST")
+	r.HandleFunc("/api/auth/logout", p.handleLogout).Methods("POST")
+	r.HandleFunc("/api/tokens", p.handleListTokens).Methods("GET")
+	r.HandleFunc("/api/tokens", p.handleCreateToken).Methods("POST")
+	r.HandleFunc("/api/tokens/{id}", p.handleDeleteToken).Methods("DELETE")
 	r.HandleFunc("/api/config", p.handleGetConfig).Methods("GET")
 	r.HandleFunc("/api/config", p.handleUpdateConfig).Methods("POST")
 	r.HandleFunc("/api/scripts", p.handleListScripts).Methods("GET")
 	r.HandleFunc("/api/scripts/{id}", p.handleGetScript).Methods("GET")
 	r.HandleFunc("/api/scripts", p.handleAddScript).Methods("POST")
+	r.HandleFunc("/api/scripts/{id}", p.handleUpdateScript).Methods("PUT")
+	r.HandleFunc("/api/scripts/{id}", p.handleDeleteScript).Methods("DELETE")
+	r.HandleFunc("/api/scripts/{id}/content", p.handleGetScriptContent).Methods("GET")
+	r.HandleFunc("/api/sensors", p.handleListSensors).Methods("GET")
+	r.HandleFunc("/api/sensors/{id}", p.handleGetSensor).Methods("GET")
+	r.HandleFunc("/api/sensors/{id}", p.handleUpdateSensor).Methods("PUT")
+	r.HandleFunc("/api/runs", p.handleListRuns).Methods("GET")
+	r.HandleFunc("/api/runs", p.handleCreateRun).Methods("POST")
+	r.HandleFunc("/api/runs/{id}", p.handleGetRun).Methods("GET")
+	r.HandleFunc("/api/runs/{id}/cancel", p.handleCancelRun).Methods("POST")
+	r.HandleFunc("/api/queue", p.handleGetQueue).Methods("GET")
+	r.HandleFunc("/api/health", p.handleGetHealth).Methods("GET")
+	r.HandleFunc("/api/status", p.handleGetStatus).Methods("GET")
+	r.HandleFunc("/api/schedules", p.handleListSchedules).Methods("GET")
+	r.HandleFunc("/api/schedules", p.handleCreateSchedule).Methods("POST")
+	r.HandleFunc("/api/schedules/{id}", p.handleGetSchedule).Methods("GET")
+	r.HandleFunc("/api/schedules/{id}", p.handleUpdateSchedule).Methods("PUT")
+	r.HandleFunc("/api/schedules/{id}", p.handleDeleteSchedule).Methods("DELETE")
+	r.HandleFunc("/api/rules", p.handleListRules).Methods("GET")
+	r.HandleFunc("/api/rules", p.handleCreateRule).Methods("POST")
+	r.HandleFunc("/api/rules/{id}", p.handleGetRule).Methods("GET")
+	r.HandleFunc("/api/rules/{id}", p.handleUpdateRule).Methods("PUT")
+	r.HandleFunc("/api/rules/{id}", p.handleDeleteRule).Methods("DELETE")
 	r.HandleFunc("/api/restart", p.handleRestartService).Methods("POST")
 	r.HandleFunc("/api/events", p.eventHandler)
 	r.HandleFunc("/api/logs", p.handleGetLogs).Methods("GET")
+	r.Handle("/metrics", p.metrics.Handler()).Methods("GET")
 	// Serve static files (our UI) - this will be added at build time from our Nuxt frontend
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir(staticPath)))
 
-	// CORS Middleware
-	corsHandler := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300, // Maximum value not ignored by any of major browsers
-	}).Handler(r)
+	p.listenHTTP()
+}
+
+// corsOrigins returns the origins that may call the API from another site. The
+// dashboard itself is served from the same origin and needs none.
+func corsOrigins(config Config) []string {
+	return strings.FieldsFunc(config.CORSAllowedOrigins, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n'
+	})
+}
+
+// listenHTTP serves the router with the current config until the server is
+// shut down by restartHTTPServer.
+func (p *program) listenHTTP() {
+	config := p.currentConfig()
+	var handler http.Handler = p.router
+	if origins := corsOrigins(config); len(origins) > 0 {
+		handler = cors.New(cors.Options{
+			AllowedOrigins:   origins,
+			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+			AllowedHeaders:   []string{"Content-Type", "Authorization"},
+			ExposedHeaders:   []string{"Link"},
+			AllowCredentials: true,
+			MaxAge:           300, // Maximum value not ignored by any of major browsers
+		}).Handler(p.router)
+	}
+
+	addr := config.HTTPAddress()
+	tlsConfig, err := newHTTPTLSConfig(config)
+	if err != nil {
+		// Never serve the API in plaintext to the network when HTTPS was asked
+		// for, but keep the dashboard reachable from this PC so the TLS
+		// settings can be fixed
+		addr = loopbackHTTPAddress(config)
+		p.Logger.Error(fmt.Sprintf("Failed to set up HTTPS, serving plain HTTP on %s only: %v", addr, err))
+	}
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+
+	p.httpMutex.Lock()
+	p.httpServer = server
+	p.httpMutex.Unlock()
+
+	if tlsConfig != nil {
+		p.Logger.Debug(fmt.Sprintf("Listening on %s (HTTPS)", server.Addr))
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		p.Logger.Debug(fmt.Sprintf("Listening on %s", server.Addr))
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		p.Logger.Error(fmt.Sprintf("HTTP server failed: %v", err))
+	}
+}
+
+// loopbackHTTPAddress returns the address to listen on when only this PC may
+// connect: the configured one if it is a loopback address, otherwise 127.0.0.1
+// on the configured port.
+func loopbackHTTPAddress(config Config) string {
+	if ip := net.ParseIP(config.HTTPListenAddress); config.HTTPListenAddress == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return config.HTTPAddress()
+	}
+	config.HTTPListenAddress = "127.0.0.1"
+	return config.HTTPAddress()
+}
+
+// restartHTTPServer stops the HTTP server and starts it again with the current
+// config. Requests in progress get a few seconds to finish; event streams never
+// do and are closed.
+func (p *program) restartHTTPServer() {
+	p.httpMutex.Lock()
+	server := p.httpServer
+	p.httpMutex.Unlock()
 
-	p.Logger.Debug("Listening on port 8077")
-	http.ListenAndServe("0.0.0.0:8077", corsHandler)
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
+	}
+	go p.listenHTTP()
 }
 
 func (p *program) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	p.Logger.Debug("Handling /api/config GET request")
-	err := json.NewEncoder(w).Encode(p.config)
+	config := p.currentConfig()
+	config.Password = redactSecret(config.Password)
+	err := json.NewEncoder(w).Encode(config)
 	if err != nil {
 		p.Logger.Error(fmt.Sprintf("Failed to encode config: %v", err))
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -67,13 +188,49 @@ func (p *program) handleUpdateConfig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
-	p.config = newConfig
-	err = p.db.UpdateConfig(&p.config)
+	if newConfig.MaxConcurrent < 0 {
+		http.Error(w, "Bad Request: max_concurrent_scripts can't be negative", http.StatusBadRequest)
+		return
+	}
+	if newConfig.LogFormat != "" && newConfig.LogFormat != logFormatText && newConfig.LogFormat != logFormatJSON {
+		http.Error(w, "Bad Request: log_format must be text or json", http.StatusBadRequest)
+		return
+	}
+	if newConfig.LogMaxSize < 0 || newConfig.LogMaxAge < 0 || newConfig.LogMaxFiles < 0 {
+		http.Error(w, "Bad Request: log_max_size_mb, log_max_age_hours and log_max_files can't be negative", http.StatusBadRequest)
+		return
+	}
+	if newConfig.HTTPPort < 0 || newConfig.HTTPPort > 65535 {
+		http.Error(w, "Bad Request: http_port must be between 1 and 65535, or 0 for the default", http.StatusBadRequest)
+		return
+	}
+	if (newConfig.HTTPTLSCertFile == "") != (newConfig.HTTPTLSKeyFile == "") {
+		http.Error(w, "Bad Request: both http_tls_cert_file and http_tls_key_file are required for HTTPS", http.StatusBadRequest)
+		return
+	}
+	config := p.currentConfig()
+	if newConfig.ID == 0 {
+		newConfig.ID = config.ID
+	}
+	if newConfig.Password, err = postedPassword(newConfig, config.Password); err != nil {
+		p.Logger.Error(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	err = p.db.UpdateConfig(&newConfig)
 	if err != nil {
 		p.Logger.Error(fmt.Sprintf("Failed to save config: %v", err))
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+
+	// Apply the new config without restarting the service
+	err = p.reloadConfig()
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to reload config: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -108,100 +265,1128 @@ func (p *program) handleGetScript(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(scriptConfig)
 }
 
+// scriptPayload is the JSON body for creating or updating a script. Content is
+// optional; when omitted the file in the scripts directory is left as is.
+type scriptPayload struct {
+	ScriptConfig
+	Content *string `json:"content,omitempty"`
+}
+
 func (p *program) handleAddScript(w http.ResponseWriter, r *http.Request) {
 	p.Logger.Debug("Handling /api/scripts POST request")
-	// Logic to add new powershell scripts
-}
+	var payload scriptPayload
 
-func (p *program) handleRestartService(w http.ResponseWriter, r *http.Request) {
-	p.Logger.Debug("Handling /api/restart POST request")
-	err := p.restartService()
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err := r.ParseMultipartForm(maxScriptSize)
+		if err != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to parse script upload: %v", err))
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to read uploaded script: %v", err))
+			http.Error(w, "Bad Request: missing file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		content, err := io.ReadAll(io.LimitReader(file, maxScriptSize+1))
+		if err != nil || len(content) > maxScriptSize {
+			http.Error(w, "Bad Request: script too large", http.StatusBadRequest)
+			return
+		}
+		contentStr := string(content)
+
+		payload.Name = r.FormValue("name")
+		payload.ScriptPath = r.FormValue("script_path")
+		if payload.ScriptPath == "" {
+			payload.ScriptPath = header.Filename
+		}
+		payload.RunAsUser, _ = strconv.ParseBool(r.FormValue("run_as_user"))
+		payload.ScriptTimeout, _ = strconv.Atoi(r.FormValue("script_timeout"))
+		payload.Interpreter = r.FormValue("interpreter")
+		payload.InterpreterArgs = r.FormValue("interpreter_args")
+		payload.Concurrency = r.FormValue("concurrency")
+		payload.Content = &contentStr
+	} else {
+		err := json.NewDecoder(io.LimitReader(r.Body, maxScriptSize*2)).Decode(&payload)
+		if err != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to decode script: %v", err))
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	scriptConfig := payload.ScriptConfig
+	scriptConfig.ID = 0
+	if scriptConfig.Name == "" {
+		scriptConfig.Name = strings.TrimSuffix(scriptConfig.ScriptPath, filepath.Ext(scriptConfig.ScriptPath))
+	}
+	if !p.validateScript(w, scriptConfig) {
+		return
+	}
+
+	if payload.Content != nil {
+		// Writing the content would replace the file of another script
+		overwrite, _ := strconv.ParseBool(r.URL.Query().Get("overwrite"))
+		exists, err := p.scriptFileExists(scriptConfig.ScriptPath)
+		if err != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to check script file: %v", err))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !overwrite && (exists || p.scriptPathInUse(scriptConfig.ScriptPath, 0)) {
+			http.Error(w, fmt.Sprintf("Conflict: %s already exists, add ?overwrite=true to replace it", scriptConfig.ScriptPath), http.StatusConflict)
+			return
+		}
+		err = p.writeScriptFile(scriptConfig.ScriptPath, []byte(*payload.Content))
+		if err != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to write script: %v", err))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	} else if _, err := p.readScriptFile(scriptConfig.ScriptPath); err != nil {
+		http.Error(w, "Bad Request: script content is required when the file doesn't exist", http.StatusBadRequest)
+		return
+	}
+
+	err := p.db.CreateScriptConfig(&scriptConfig)
 	if err != nil {
-		p.Logger.Error(fmt.Sprintf("Failed to restart service: %v", err))
+		p.Logger.Error(fmt.Sprintf("Failed to save script config: %v", err))
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+
+	p.applyScriptChange()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(scriptConfig)
 }
 
-func (p *program) eventHandler(w http.ResponseWriter, r *http.Request) {
-	p.Logger.Debug("Handling /api/events SSE Events")
-	// Set CORS headers to allow all origins. You may want to restrict this to specific origins in a production environment.
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Type")
+func (p *program) handleUpdateScript(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/scripts/:id PUT request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+	existing, err := p.db.GetScriptConfig(id)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get script config: %v", err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+	var payload scriptPayload
+	err = json.NewDecoder(io.LimitReader(r.Body, maxScriptSize*2)).Decode(&payload)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to decode script: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
 
-	// Create a new channel for this client
-	events := make(chan []byte)
-	p.eventChannels = append(p.eventChannels, events)
-	defer func() {
-		// Remove this client's channel when the connection is closed
-		for i, ch := range p.eventChannels {
-			if ch == events {
-				p.eventChannels = append(p.eventChannels[:i], p.eventChannels[i+1:]...)
-				break
-			}
+	scriptConfig := payload.ScriptConfig
+	scriptConfig.ID = id
+	scriptConfig.CreatedAt = existing.CreatedAt
+	if scriptConfig.ScriptPath == "" {
+		scriptConfig.ScriptPath = existing.ScriptPath
+	}
+	if !p.validateScript(w, scriptConfig) {
+		return
+	}
+
+	moved := scriptConfig.ScriptPath != existing.ScriptPath
+	if moved {
+		exists, err := p.scriptFileExists(scriptConfig.ScriptPath)
+		if err != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to check script file: %v", err))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
 		}
-		close(events)
-	}()
+		if exists || p.scriptPathInUse(scriptConfig.ScriptPath, id) {
+			http.Error(w, fmt.Sprintf("Conflict: %s already exists", scriptConfig.ScriptPath), http.StatusConflict)
+			return
+		}
+		if payload.Content == nil && p.scriptPathInUse(existing.ScriptPath, id) {
+			http.Error(w, fmt.Sprintf("Conflict: %s is used by another script as well, send the content to copy it to %s instead", existing.ScriptPath, scriptConfig.ScriptPath), http.StatusConflict)
+			return
+		}
+	}
 
-	// Stream events to the client
-	for {
-		select {
-		case event := <-events:
-			fmt.Fprintf(w, "data: %s\n\n", event)
-			flusher.Flush()
-		case <-r.Context().Done():
+	// Keep the content that is overwritten so it can be put back if the config
+	// can't be saved. It stays nil if there was no file.
+	var previous []byte
+	if payload.Content != nil && !moved {
+		previous, err = p.readScriptFile(existing.ScriptPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			p.Logger.Error(fmt.Sprintf("Failed to read script: %v", err))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 	}
-}
 
-func (p *program) handleGetLogs(w http.ResponseWriter, r *http.Request) {
-	p.Logger.Debug("Handling /api/logs GET request")
-	exePath, err := os.Executable()
+	if payload.Content != nil {
+		err = p.writeScriptFile(scriptConfig.ScriptPath, []byte(*payload.Content))
+	} else if moved {
+		err = p.renameScriptFile(existing.ScriptPath, scriptConfig.ScriptPath)
+	}
+	if errors.Is(err, os.ErrExist) {
+		http.Error(w, fmt.Sprintf("Conflict: %s already exists", scriptConfig.ScriptPath), http.StatusConflict)
+		return
+	}
 	if err != nil {
-		p.Logger.Error(fmt.Sprintf("failed to get executable path: %v", err))
+		p.Logger.Error(fmt.Sprintf("Failed to write script: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
-	dir := filepath.Join(filepath.Dir(exePath), "WinSenseConnect.log")
-	// Read the log file
-	logContent, err := os.ReadFile(dir)
+
+	err = p.db.UpdateScriptConfig(&scriptConfig)
 	if err != nil {
-		if os.IsNotExist(err) {
-			// If the file doesn't exist, return an empty log array
-			p.Logger.Debug("Log file not found. Returning empty log array.")
-			json.NewEncoder(w).Encode(map[string]string{"logs": ""})
-			return
+		p.Logger.Error(fmt.Sprintf("Failed to save script config: %v", err))
+		// Undo the file change, the stored config still points at the old file
+		var undoErr error
+		switch {
+		case payload.Content != nil && (moved || previous == nil):
+			undoErr = p.removeScriptFile(scriptConfig.ScriptPath)
+		case payload.Content != nil:
+			undoErr = p.writeScriptFile(existing.ScriptPath, previous)
+		case moved:
+			undoErr = p.renameScriptFile(scriptConfig.ScriptPath, existing.ScriptPath)
+		}
+		if undoErr != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to restore script file: %v", undoErr))
 		}
-		p.Logger.Error(fmt.Sprintf("Failed to read log file: %v", err))
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	// Create a response struct
-	response := struct {
-		Logs string `json:"logs"`
-	}{
-		Logs: string(logContent),
+	// The content went to the new path, remove the old file so
+	// AddScriptsFromDir doesn't register it again as another script
+	if moved && payload.Content != nil && !p.scriptPathInUse(existing.ScriptPath, id) {
+		if err := p.removeScriptFile(existing.ScriptPath); err != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to remove old script file: %v", err))
+		}
 	}
 
-	// Set the content type to JSON
+	p.applyScriptChange()
 	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scriptConfig)
+}
+
+func (p *program) handleDeleteScript(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/scripts/:id DELETE request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := p.db.GetScriptConfig(id)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get script config: %v", err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	err = p.db.DeleteScriptConfig(id)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to delete script config: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Remove the file as well, otherwise AddScriptsFromDir registers it again on
+	// the next start
+	if _, err := p.scriptFilePath(existing.ScriptPath); err == nil && !p.scriptPathInUse(existing.ScriptPath, id) {
+		if err := p.removeScriptFile(existing.ScriptPath); err != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to remove script file: %v", err))
+		}
+	}
+
+	p.applyScriptChange()
+	// Deleting a script deletes its schedules too, and detaches it from rules
+	if err := p.reloadSchedules(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to reload schedules: %v", err))
+	}
+	if err := p.reloadRules(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to reload sensor rules: %v", err))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *program) handleGetScriptContent(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/scripts/:id/content GET request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	scriptConfig, err := p.db.GetScriptConfig(id)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get script config: %v", err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	content, err := p.readScriptFile(scriptConfig.ScriptPath)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to read script: %v", err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(content)
+}
+
+// validateScript checks a script config before it is saved and writes the
+// error response if it isn't valid.
+func (p *program) validateScript(w http.ResponseWriter, scriptConfig ScriptConfig) bool {
+	if strings.TrimSpace(scriptConfig.Name) == "" {
+		http.Error(w, "Bad Request: name is required", http.StatusBadRequest)
+		return false
+	}
+	if scriptConfig.ScriptTimeout < 0 {
+		http.Error(w, "Bad Request: script_timeout can't be negative", http.StatusBadRequest)
+		return false
+	}
+	if scriptConfig.Name == cancelCommand {
+		http.Error(w, fmt.Sprintf("Bad Request: '%s' is a reserved command name", cancelCommand), http.StatusBadRequest)
+		return false
+	}
+	if !validConcurrency(scriptConfig.Concurrency) {
+		http.Error(w, fmt.Sprintf("Bad Request: invalid concurrency '%s'", scriptConfig.Concurrency), http.StatusBadRequest)
+		return false
+	}
+	if _, err := p.scriptFilePath(scriptConfig.ScriptPath); err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+		return false
+	}
+	conflict, err := p.scriptNameConflict(scriptConfig.Name, scriptConfig.ID)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get script configs: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	if conflict == scriptConfig.Name {
+		http.Error(w, fmt.Sprintf("Conflict: a script named '%s' already exists", scriptConfig.Name), http.StatusConflict)
+		return false
+	}
+	if conflict != "" {
+		http.Error(w, fmt.Sprintf("Conflict: '%s' would share its Home Assistant entity with the script '%s'", scriptConfig.Name, conflict), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// applyScriptChange reloads the config so Config.Commands and the Home
+// Assistant discovery configs reflect the change. The change itself is already
+// saved, so a failure here is only logged.
+func (p *program) applyScriptChange() {
+	if err := p.reloadConfig(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to reload config: %v", err))
+	}
+}
+
+func (p *program) handleListSensors(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/sensors GET request")
+
+	sensorConfigs, err := p.db.GetSensorConfigs()
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get sensor configs: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(sensorConfigs)
+}
+
+func (p *program) handleGetSensor(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/sensors/:id GET request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	sensorConfig, err := p.db.GetSensorConfig(id)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get sensor config: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(sensorConfig)
+}
+
+func (p *program) handleUpdateSensor(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/sensors/:id PUT request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	var sensorConfig SensorConfig
+	err = json.NewDecoder(r.Body).Decode(&sensorConfig)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to decode sensor config: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	sensorConfig.ID = id
+
+	err = p.db.UpdateSensorConfig(&sensorConfig)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to save sensor config: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Start, stop or restart the sensor without restarting the service
+	err = p.reloadSensors()
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to reload sensors: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	// Encode and send the response
-	err = json.NewEncoder(w).Encode(response)
+func (p *program) handleListSchedules(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/schedules GET request")
+
+	schedules, err := p.db.GetSchedules()
 	if err != nil {
-		p.Logger.Error(fmt.Sprintf("Failed to encode log response: %v", err))
+		p.Logger.Error(fmt.Sprintf("Failed to get schedules: %v", err))
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+func (p *program) handleGetSchedule(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/schedules/:id GET request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	schedule, err := p.db.GetSchedule(id)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get schedule: %v", err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+func (p *program) handleCreateSchedule(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/schedules POST request")
+	schedule := Schedule{Enabled: true, MissedRunPolicy: missedRunSkip}
+	err := json.NewDecoder(r.Body).Decode(&schedule)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to decode schedule: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !p.validateSchedule(w, schedule) {
+		return
+	}
+
+	err = p.db.CreateSchedule(&schedule)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to create schedule: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := p.reloadSchedules(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to reload schedules: %v", err))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(schedule)
+}
+
+func (p *program) handleUpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/schedules/:id PUT request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := p.db.GetSchedule(id)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get schedule: %v", err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	schedule := *existing
+	err = json.NewDecoder(r.Body).Decode(&schedule)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to decode schedule: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	schedule.ID = id
+	schedule.LastRunAt = existing.LastRunAt
+	schedule.CreatedAt = existing.CreatedAt
+	if !p.validateSchedule(w, schedule) {
+		return
+	}
+
+	err = p.db.UpdateSchedule(&schedule)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to save schedule: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Start, stop or restart the schedule without restarting the service
+	if err := p.reloadSchedules(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to reload schedules: %v", err))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+func (p *program) handleDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/schedules/:id DELETE request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := p.db.GetSchedule(id); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get schedule: %v", err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	err = p.db.DeleteSchedule(id)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to delete schedule: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := p.reloadSchedules(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to reload schedules: %v", err))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateSchedule checks a schedule before it is saved and writes the error
+// response if it isn't valid.
+func (p *program) validateSchedule(w http.ResponseWriter, schedule Schedule) bool {
+	if err := checkSchedule(schedule); err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+		return false
+	}
+	if _, err := p.db.GetScriptConfig(schedule.ScriptID); err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request: script %d doesn't exist", schedule.ScriptID), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (p *program) handleListRules(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/rules GET request")
+
+	rules, err := p.db.GetSensorRules()
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get sensor rules: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func (p *program) handleGetRule(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/rules/:id GET request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	rule, err := p.db.GetSensorRule(id)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get sensor rule: %v", err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func (p *program) handleCreateRule(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/rules POST request")
+	rule := SensorRule{Enabled: true, Interval: defaultRuleInterval}
+	err := json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to decode sensor rule: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !p.validateRule(w, rule) {
+		return
+	}
+
+	err = p.db.CreateSensorRule(&rule)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to create sensor rule: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := p.reloadRules(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to reload sensor rules: %v", err))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+func (p *program) handleUpdateRule(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/rules/:id PUT request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := p.db.GetSensorRule(id)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get sensor rule: %v", err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	rule := *existing
+	err = json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to decode sensor rule: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	rule.ID = id
+	rule.CreatedAt = existing.CreatedAt
+	if !p.validateRule(w, rule) {
+		return
+	}
+
+	err = p.db.UpdateSensorRule(&rule)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to save sensor rule: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Start, stop or restart the rule without restarting the service
+	if err := p.reloadRules(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to reload sensor rules: %v", err))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func (p *program) handleDeleteRule(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/rules/:id DELETE request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := p.db.GetSensorRule(id); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get sensor rule: %v", err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	err = p.db.DeleteSensorRule(id)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to delete sensor rule: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := p.reloadRules(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to reload sensor rules: %v", err))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateRule checks a sensor rule before it is saved and writes the error
+// response if it isn't valid.
+func (p *program) validateRule(w http.ResponseWriter, rule SensorRule) bool {
+	if err := checkSensorRule(rule); err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+		return false
+	}
+	if rule.ScriptID != 0 {
+		if _, err := p.db.GetScriptConfig(rule.ScriptID); err != nil {
+			http.Error(w, fmt.Sprintf("Bad Request: script %d doesn't exist", rule.ScriptID), http.StatusBadRequest)
+			return false
+		}
+	}
+	return true
+}
+
+func (p *program) handleListRuns(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/runs GET request")
+	query := r.URL.Query()
+
+	filter := ScriptRunFilter{
+		Command: query.Get("command"),
+		Status:  query.Get("status"),
+		Limit:   100,
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "Bad Request: since must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		filter.Since = filter.Since.UTC()
+	}
+	if until := query.Get("until"); until != "" {
+		filter.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			http.Error(w, "Bad Request: until must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		filter.Until = filter.Until.UTC()
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit <= 0 || filter.Limit > 1000 {
+			http.Error(w, "Bad Request: limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	scriptRuns, err := p.db.GetScriptRuns(filter)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get script runs: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scriptRuns)
+}
+
+func (p *program) handleGetRun(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/runs/:id GET request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	scriptRun, err := p.db.GetScriptRun(id)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get script run: %v", err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scriptRun)
+}
+
+func (p *program) handleCreateRun(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/runs POST request")
+	var request scriptRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Command == "" {
+		p.Logger.Error(fmt.Sprintf("Failed to decode run request: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	request.Source = runSourceHTTP
+
+	scriptRun, err := p.runScript(request)
+	if errors.Is(err, errUnknownCommand) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errInvalidRequest) {
+		http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, errCommandBusy) {
+		w.WriteHeader(http.StatusConflict)
+	} else if err != nil {
+		p.Logger.Error(fmt.Sprintf("Error executing script for command '%s': %v", request.Command, err))
+	}
+	json.NewEncoder(w).Encode(scriptRun)
+}
+
+func (p *program) handleCancelRun(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/runs/:id/cancel POST request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	cancelled := p.executor.cancelRuns(func(run *ScriptRun) bool {
+		return run.ID == id
+	})
+	if cancelled == 0 {
+		if _, err := p.db.GetScriptRun(id); err != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Conflict: run is not queued or running", http.StatusConflict)
+		return
+	}
+	p.Logger.Debug(fmt.Sprintf("Cancelled script run %d", id))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (p *program) handleGetQueue(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/queue GET request")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.executor.Status())
+}
+
+func (p *program) handleGetHealth(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/health GET request")
+	health := p.serviceStatus().health()
+	w.Header().Set("Content-Type", "application/json")
+	if health.Status != componentOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+func (p *program) handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/status GET request")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.serviceStatus())
+}
+
+func (p *program) handleAuthStatus(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/auth/status GET request")
+	count, err := p.db.CountUsers()
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to count users: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	status := authStatus{SetupRequired: count == 0}
+	status.SetupTokenRequired = status.SetupRequired && !isLoopback(r)
+	status.Username, status.Authenticated = p.authenticate(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (p *program) handleAuthSetup(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/auth/setup POST request")
+	var setup setupRequest
+	if err := json.NewDecoder(r.Body).Decode(&setup); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to decode credentials: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !p.setupAllowed(r, setup.SetupToken) {
+		p.Logger.Warn("Rejected account setup without a valid setup token", "remote_addr", r.RemoteAddr)
+		http.Error(w, fmt.Sprintf("Forbidden: setup from another computer requires the setup token in %s", setupTokenFile), http.StatusForbidden)
+		return
+	}
+	c := setup.credentials
+	if err := checkCredentials(c); err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassword(c.Password)
+	if err != nil {
+		p.Logger.Error(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	user := User{Username: strings.TrimSpace(c.Username), PasswordHash: hash}
+	created, err := p.db.CreateFirstUser(&user)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to create user: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !created {
+		http.Error(w, "Conflict: setup was already completed", http.StatusConflict)
+		return
+	}
+	p.Logger.Debug(fmt.Sprintf("Created user '%s'", user.Username))
+	if err := os.Remove(resolveConfigPath(setupTokenFile)); err != nil && !os.IsNotExist(err) {
+		p.Logger.Error(fmt.Sprintf("Failed to remove the setup token: %v", err))
+	}
+
+	if err := p.startSession(w, r, &user); err != nil {
+		p.Logger.Error(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+func (p *program) handleLogin(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/auth/login POST request")
+	var c credentials
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to decode credentials: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	user, err := p.db.GetUserByUsername(strings.TrimSpace(c.Username))
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(c.Password)) != nil {
+		p.Logger.Error(fmt.Sprintf("Failed login for user '%s' from %s", c.Username, r.RemoteAddr))
+		http.Error(w, "Unauthorized: invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	if err := p.startSession(w, r, user); err != nil {
+		p.Logger.Error(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+func (p *program) handleLogout(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/auth/logout POST request")
+	if err := p.endSession(w, r); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to delete session: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *program) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/tokens GET request")
+	tokens, err := p.db.GetAPITokens()
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get API tokens: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (p *program) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/tokens POST request")
+	var token APIToken
+	if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to decode API token: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	token.Name = strings.TrimSpace(token.Name)
+	if token.Name == "" {
+		http.Error(w, "Bad Request: name is required", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		p.Logger.Error(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	secret = apiTokenPrefix + secret
+	token.TokenHash = hashSecret(secret)
+	if err := p.db.CreateAPIToken(&token); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to create API token: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	p.Logger.Debug(fmt.Sprintf("Created API token '%s'", token.Name))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newAPITokenResponse{APIToken: token, Token: secret})
+}
+
+func (p *program) handleDeleteToken(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/tokens/:id DELETE request")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to parse id: %v", err))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = p.db.DeleteAPIToken(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to delete API token: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *program) handleRestartService(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/restart POST request")
+	err := p.restartService()
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to restart service: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (p *program) eventHandler(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/events SSE Events")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
+
+	// Create a new channel for this client
+	events := make(chan []byte)
+	p.eventMutex.Lock()
+	p.eventChannels = append(p.eventChannels, events)
+	p.eventMutex.Unlock()
+	defer func() {
+		// Remove this client's channel when the connection is closed
+		p.eventMutex.Lock()
+		defer p.eventMutex.Unlock()
+		for i, ch := range p.eventChannels {
+			if ch == events {
+				p.eventChannels = append(p.eventChannels[:i], p.eventChannels[i+1:]...)
+				break
+			}
+		}
+		close(events)
+	}()
+
+	// Stream events to the client
+	for {
+		select {
+		case event := <-events:
+			fmt.Fprintf(w, "data: %s\n\n", event)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (p *program) handleGetLogs(w http.ResponseWriter, r *http.Request) {
+	p.Logger.Debug("Handling /api/logs GET request")
+	query := r.URL.Query()
+
+	q := logQuery{
+		Text:  query.Get("q"),
+		Limit: defaultLogQueryLimit,
+	}
+
+	var err error
+	if level := query.Get("level"); level != "" {
+		var ok bool
+		q.Level, ok = parseLogLevel(level)
+		if !ok {
+			http.Error(w, "Bad Request: level must be error, warn, info or debug", http.StatusBadRequest)
+			return
+		}
+	}
+	if since := query.Get("since"); since != "" {
+		q.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "Bad Request: since must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		q.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			http.Error(w, "Bad Request: until must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit <= 0 || q.Limit > maxLogQueryLimit {
+			http.Error(w, fmt.Sprintf("Bad Request: limit must be between 1 and %d", maxLogQueryLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		q.Cursor, err = parseLogCursor(cursor)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// p.Logger is the common.Logger interface, only the file logger can be queried
+	logger, ok := p.Logger.(*Logger)
+	if !ok {
+		http.Error(w, "Not Implemented: logs are not written to a file", http.StatusNotImplemented)
+		return
+	}
+	page, err := logger.Query(q)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to read logs: %v", err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
 }
@@ -0,0 +1,50 @@
+package bgService
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// interpreter describes how scripts with a given file extension are run.
+type interpreter struct {
+	// Command is the program that runs the script. Empty means the script is
+	// executed directly.
+	Command string
+	// Args are passed to Command before the script path.
+	Args []string
+	// NamedParams passes the request arguments as "-name value" parameters
+	// after the script path, as PowerShell expects. Every interpreter gets
+	// them as WINSENSE_ARG_* environment variables.
+	NamedParams bool
+}
+
+// lookupInterpreter returns the interpreter registered for the extension of
+// scriptPath. Scripts with an unknown extension are executed directly.
+func lookupInterpreter(scriptPath string) interpreter {
+	return interpreters[strings.ToLower(filepath.Ext(scriptPath))]
+}
+
+// scriptCommand builds the program and arguments that run scriptPath. The
+// interpreter path and extra arguments configured on the script override the
+// ones registered for its extension.
+func scriptCommand(scriptPath string, scriptConfig ScriptConfig, args scriptArgs) (string, []string) {
+	interp := lookupInterpreter(scriptPath)
+	if scriptConfig.Interpreter != "" {
+		interp.Command = scriptConfig.Interpreter
+		interp.Args = nil
+	}
+	cmdArgs := append([]string{}, interp.Args...)
+	cmdArgs = append(cmdArgs, strings.Fields(scriptConfig.InterpreterArgs)...)
+
+	name := interp.Command
+	if name == "" {
+		// Extra arguments of a directly executed script go after it
+		name = scriptPath
+	} else {
+		cmdArgs = append(cmdArgs, scriptPath)
+	}
+	if interp.NamedParams {
+		cmdArgs = append(cmdArgs, args.Params()...)
+	}
+	return name, cmdArgs
+}
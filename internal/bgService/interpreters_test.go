@@ -0,0 +1,78 @@
+package bgService
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScriptCommand(t *testing.T) {
+	old := interpreters
+	interpreters = map[string]interpreter{
+		".ps1": {Command: "pwsh", Args: []string{"-File"}, NamedParams: true},
+		".py":  {Command: "python3"},
+	}
+	defer func() { interpreters = old }()
+
+	args := scriptArgs{names: []string{"level", "target"}, values: map[string]string{"level": "30", "target": "tv"}}
+	tests := []struct {
+		name         string
+		scriptPath   string
+		scriptConfig ScriptConfig
+		command      string
+		cmdArgs      []string
+	}{
+		{
+			name:       "registered extension",
+			scriptPath: "/scripts/backup.py",
+			command:    "python3",
+			cmdArgs:    []string{"/scripts/backup.py"},
+		},
+		{
+			name:       "extension case is ignored",
+			scriptPath: "/scripts/BACKUP.PY",
+			command:    "python3",
+			cmdArgs:    []string{"/scripts/BACKUP.PY"},
+		},
+		{
+			name:       "named parameters",
+			scriptPath: "/scripts/volume.ps1",
+			command:    "pwsh",
+			cmdArgs:    []string{"-File", "/scripts/volume.ps1", "-level", "30", "-target", "tv"},
+		},
+		{
+			name:         "interpreter override drops the registered arguments",
+			scriptPath:   "/scripts/volume.ps1",
+			scriptConfig: ScriptConfig{Interpreter: "/opt/pwsh/pwsh", InterpreterArgs: "-NoProfile  -File"},
+			command:      "/opt/pwsh/pwsh",
+			cmdArgs:      []string{"-NoProfile", "-File", "/scripts/volume.ps1", "-level", "30", "-target", "tv"},
+		},
+		{
+			name:         "extra arguments",
+			scriptPath:   "/scripts/backup.py",
+			scriptConfig: ScriptConfig{InterpreterArgs: "-u"},
+			command:      "python3",
+			cmdArgs:      []string{"-u", "/scripts/backup.py"},
+		},
+		{
+			name:       "unknown extension is executed directly",
+			scriptPath: "/scripts/lock",
+			command:    "/scripts/lock",
+			cmdArgs:    []string{},
+		},
+		{
+			name:         "arguments of a directly executed script",
+			scriptPath:   "/scripts/lock",
+			scriptConfig: ScriptConfig{InterpreterArgs: "--now"},
+			command:      "/scripts/lock",
+			cmdArgs:      []string{"--now"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, cmdArgs := scriptCommand(tt.scriptPath, tt.scriptConfig, args)
+			if command != tt.command || !reflect.DeepEqual(cmdArgs, tt.cmdArgs) {
+				t.Errorf("command = %q %q, want %q %q", command, cmdArgs, tt.command, tt.cmdArgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package bgService
+
+// interpreters maps lower-case script extensions to the program that runs
+// them. Files without a registered extension must be executable and are run
+// directly, so they can pick their own interpreter with a shebang line.
+var interpreters = map[string]interpreter{
+	".ps1": {Command: "pwsh", Args: []string{"-File"}, NamedParams: true},
+	".sh":  {Command: shellPath()},
+	".py":  {Command: "python3"},
+	".js":  {Command: "node"},
+}
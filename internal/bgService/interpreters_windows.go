@@ -0,0 +1,12 @@
+package bgService
+
+// interpreters maps lower-case script extensions to the program that runs
+// them. .exe and .com files are executed directly.
+var interpreters = map[string]interpreter{
+	".ps1": {Command: "powershell", Args: []string{"-ExecutionPolicy", "Bypass", "-File"}, NamedParams: true},
+	".bat": {Command: "cmd.exe", Args: []string{"/D", "/C"}},
+	".cmd": {Command: "cmd.exe", Args: []string{"/D", "/C"}},
+	".py":  {Command: "python"},
+	".sh":  {Command: "bash"},
+	".js":  {Command: "node"},
+}
@@ -0,0 +1,270 @@
+package bgService
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logTimeLayout is the timestamp log.LstdFlags writes at the start of a text
+// line.
+const logTimeLayout = "2006/01/02 15:04:05"
+
+// rotatedTimeLayout is the timestamp in the name of a rotated log file. It
+// sorts in the order the files were rotated, and has milliseconds so a burst
+// of rotations doesn't reuse a name.
+const rotatedTimeLayout = "20060102-150405.000"
+
+// logRotation limits the size and age of the log file. Zero disables a limit.
+type logRotation struct {
+	MaxSize  int64
+	MaxAge   time.Duration
+	MaxFiles int
+	Compress bool
+}
+
+// defaultLogRotation applies until the config is loaded.
+var defaultLogRotation = logRotation{
+	MaxSize:  10 * 1024 * 1024,
+	MaxAge:   24 * time.Hour,
+	MaxFiles: 5,
+}
+
+func newLogRotation(config *Config) logRotation {
+	if config == nil {
+		return defaultLogRotation
+	}
+	return logRotation{
+		MaxSize:  int64(config.LogMaxSize) * 1024 * 1024,
+		MaxAge:   time.Duration(config.LogMaxAge) * time.Hour,
+		MaxFiles: config.LogMaxFiles,
+		Compress: config.LogCompress,
+	}
+}
+
+// logFile is an append-only log file that is kept open between writes and
+// rotated to a timestamped name once it grows too large or too old. Rotated
+// files are compressed and pruned in the background.
+type logFile struct {
+	path      string
+	mu        sync.Mutex
+	file      *os.File
+	size      int64
+	startedAt time.Time
+	// cleanupMu keeps compressing and pruning of two rotations apart
+	cleanupMu sync.Mutex
+}
+
+func newLogFile(path string) *logFile {
+	return &logFile{path: path}
+}
+
+// Write appends p, rotating the file first when writing p would exceed the
+// limits.
+func (f *logFile) Write(p []byte, rotation logRotation) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	if f.size > 0 && f.needsRotation(int64(len(p)), rotation) {
+		if err := f.rotate(rotation); err != nil {
+			// Keep logging to the current file rather than losing messages
+			fmt.Fprintf(os.Stderr, "failed to rotate log file: %v\n", err)
+			if f.file == nil {
+				if err := f.open(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return err
+}
+
+func (f *logFile) needsRotation(size int64, rotation logRotation) bool {
+	if rotation.MaxSize > 0 && f.size+size > rotation.MaxSize {
+		return true
+	}
+	return rotation.MaxAge > 0 && time.Since(f.startedAt) > rotation.MaxAge
+}
+
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.startedAt = firstLogTime(f.path)
+	return nil
+}
+
+// firstLogTime returns when the log file was started, read from the timestamp
+// of its first line, so the age limit holds across service restarts.
+func firstLogTime(path string) time.Time {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Now()
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil {
+		return time.Now()
+	}
+	entry, ok := parseLogLine(strings.TrimRight(line, "\r\n"), "")
+	if !ok {
+		return time.Now()
+	}
+	return entry.Timestamp
+}
+
+func (f *logFile) rotate(rotation logRotation) error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	renameErr := os.Rename(f.path, f.rotatedName(time.Now()))
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	// The new file starts now, not at the first line of the old one
+	f.startedAt = time.Now()
+
+	go f.cleanup(rotation)
+	return nil
+}
+
+// rotatedName returns an unused name for the file rotated at t. os.Rename
+// replaces an existing file, so when two rotations fall in the same
+// millisecond, the later one moves to the next free millisecond.
+func (f *logFile) rotatedName(t time.Time) string {
+	ext := filepath.Ext(f.path)
+	for {
+		name := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(f.path, ext), t.Format(rotatedTimeLayout), ext)
+		if !fileExists(name) && !fileExists(name+".gz") {
+			return name
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return !os.IsNotExist(err)
+}
+
+// cleanup removes the oldest rotated files beyond MaxFiles and compresses the
+// remaining ones. It handles every rotated file, not just the latest, so
+// cleanups that run out of order or were interrupted don't leave files behind.
+func (f *logFile) cleanup(rotation logRotation) {
+	f.cleanupMu.Lock()
+	defer f.cleanupMu.Unlock()
+
+	files, err := f.rotatedFiles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list rotated log files: %v\n", err)
+		return
+	}
+	for rotation.MaxFiles > 0 && len(files) > rotation.MaxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to remove %s: %v\n", files[0], err)
+		}
+		files = files[1:]
+	}
+
+	if !rotation.Compress {
+		return
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, ".gz") {
+			continue
+		}
+		if err := compressFile(file); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to compress %s: %v\n", file, err)
+		}
+	}
+}
+
+// rotatedFiles lists the rotated log files, oldest first.
+func (f *logFile) rotatedFiles() ([]string, error) {
+	ext := filepath.Ext(f.path)
+	pattern := strings.TrimSuffix(f.path, ext) + "-*" + ext
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := filepath.Glob(pattern + ".gz")
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, compressed...)
+	sort.Strings(files)
+	return files, nil
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		gz.Close()
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	src.Close()
+	return os.Remove(path)
+}
+
+// Close closes the file. A later Write opens it again.
+func (f *logFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,122 @@
+package bgService
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogFileRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.log")
+	f := newLogFile(path)
+	defer f.Close()
+	rotation := logRotation{MaxSize: 16}
+
+	for _, line := range []string{"first line\n", "second line\n"} {
+		if err := f.Write([]byte(line), rotation); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated, err := f.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 1 {
+		t.Fatalf("got %d rotated files, want 1", len(rotated))
+	}
+	if content, _ := os.ReadFile(rotated[0]); string(content) != "first line\n" {
+		t.Errorf("rotated file has %q", content)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "second line\n" {
+		t.Errorf("current file has %q", content)
+	}
+}
+
+func TestLogFileCleanup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.log")
+	f := newLogFile(path)
+	at := time.Date(2026, 3, 10, 8, 0, 0, 0, time.Local)
+
+	var names []string
+	for i := 0; i < 5; i++ {
+		name := strings.TrimSuffix(path, ".log") + "-" + at.Add(time.Duration(i)*time.Second).Format(rotatedTimeLayout) + ".log"
+		// One file is left compressed by an earlier cleanup
+		if i == 3 {
+			name += ".gz"
+		}
+		if err := os.WriteFile(name, []byte(filepath.Base(name)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	f.cleanup(logRotation{MaxFiles: 3, Compress: true})
+
+	rotated, err := f.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 3 {
+		t.Fatalf("got %d rotated files, want the 3 newest: %v", len(rotated), rotated)
+	}
+	for i, name := range []string{names[2] + ".gz", names[3], names[4] + ".gz"} {
+		if rotated[i] != name {
+			t.Errorf("rotated file %d is %s, want %s", i, filepath.Base(rotated[i]), filepath.Base(name))
+		}
+	}
+
+	// Compressing keeps the content
+	file, err := os.Open(names[4] + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := io.ReadAll(gz); string(content) != filepath.Base(names[4]) {
+		t.Errorf("compressed file has %q", content)
+	}
+}
+
+func TestRotatedNameIsUnique(t *testing.T) {
+	dir := t.TempDir()
+	f := newLogFile(filepath.Join(dir, "service.log"))
+	at := time.Date(2026, 3, 10, 8, 0, 0, 0, time.Local)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		name := f.rotatedName(at)
+		if seen[name] {
+			t.Fatalf("rotation %d reused %s", i, name)
+		}
+		seen[name] = true
+		// Leave every other one compressed, like cleanup does
+		if i%2 == 1 {
+			name += ".gz"
+		}
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated, err := f.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 5 {
+		t.Fatalf("got %d rotated files, want 5", len(rotated))
+	}
+	for i, path := range rotated {
+		rotatedAt, ok := f.rotatedAt(path)
+		if want := at.Add(time.Duration(i) * time.Millisecond); !ok || !rotatedAt.Equal(want) {
+			t.Errorf("%s rotated at %s, want %s", filepath.Base(path), rotatedAt, want)
+		}
+	}
+}
@@ -6,24 +6,47 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
-
-	"golang.org/x/sys/windows/svc/eventlog"
 )
 
 type LogLevel int
 
+// Levels from least to most verbose. A level includes the ones before it.
 const (
 	LogOff LogLevel = iota
 	LogErrors
+	LogWarn
+	LogInfo
 	LogDebug
 )
 
+// Log file formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// badFieldKey is the key of a field value that has no key, like log/slog's.
+const badFieldKey = "!BADKEY"
+
+// systemLog is the OS log the Logger mirrors its messages to: the Windows Event
+// Log on Windows, syslog/journald elsewhere.
+type systemLog interface {
+	Info(eid uint32, msg string) error
+	Warning(eid uint32, msg string) error
+	Error(eid uint32, msg string) error
+	Close() error
+}
+
 type Logger struct {
-	filePath     string
-	config       *Config
-	elog         *eventlog.Log
+	file *logFile
+	// config returns the current config, which a reload may replace at any
+	// time. It is nil until the config is loaded.
+	config       func() Config
+	elog         systemLog
 	eventHandler func(event []byte)
 }
 
@@ -31,65 +54,77 @@ type LogEvent struct {
 	Timestamp time.Time `json:"timestamp"`
 	Message   string    `json:"message"`
 	Level     string    `json:"level"`
+	// Fields are the key/value pairs passed with the message
+	Fields map[string]any `json:"fields,omitempty"`
+	// Source is the log file an entry was read from by /api/logs
+	Source string `json:"source,omitempty"`
 }
 
-func NewLogger(filename string, config *Config, serviceName string, eventHandler func(event []byte)) (*Logger, error) {
+func NewLogger(filename string, config func() Config, serviceName string, eventHandler func(event []byte)) (*Logger, error) {
 	logPath, err := getLogFilePath(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	elog, err := eventlog.Open(serviceName)
+	elog, err := openSystemLog(serviceName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open event log: %v", err)
+		return nil, err
 	}
 
 	return &Logger{
-		filePath:     logPath,
+		file:         newLogFile(logPath),
 		config:       config,
 		elog:         elog,
 		eventHandler: eventHandler,
 	}, nil
 }
 
-func (l *Logger) Log(message string, level LogLevel) {
+func (l *Logger) Log(message string, level LogLevel, fields ...any) {
+	var config *Config
+	if l.config != nil {
+		current := l.config()
+		config = &current
+	}
+
 	var configLevel LogLevel
-	if l.config == nil {
+	if config == nil {
 		configLevel = LogDebug // Default to debug level if config is nil
 	} else {
-		configLevel = getLogLevel(l.config.LogLevel)
+		configLevel = getLogLevel(config.LogLevel)
 	}
 
 	if level > configLevel {
 		return
 	}
 
+	event := LogEvent{
+		Timestamp: time.Now(),
+		Message:   message,
+		Level:     level.String(),
+		Fields:    newLogFields(fields),
+	}
+
 	// File logging
-	f, err := os.OpenFile(l.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	line, err := formatLogLine(event, config)
 	if err != nil {
 		log.Println(err)
-	} else {
-		defer f.Close()
-		logger := log.New(f, "", log.LstdFlags)
-		logger.Println(message)
-		f.Sync() // Force write to disk
+	} else if err := l.file.Write(line, newLogRotation(config)); err != nil {
+		log.Println(err)
 	}
 
-	// Windows Event logging
+	// Windows Event Log / syslog
+	text := event.text()
 	switch level {
-	case LogDebug:
-		l.elog.Info(1, message)
+	case LogDebug, LogInfo:
+		l.elog.Info(1, text)
+	case LogWarn:
+		l.elog.Warning(1, text)
 	case LogErrors:
-		l.elog.Error(1, message)
+		l.elog.Error(1, text)
 	}
 
 	// Send event to eventHandler
 	if l.eventHandler != nil {
-		event := LogEvent{
-			Timestamp: time.Now(),
-			Message:   message,
-			Level:     level.String(),
-		}
 		jsonEvent, err := json.Marshal(event)
 		if err == nil {
 			l.eventHandler(jsonEvent)
@@ -97,24 +132,109 @@ func (l *Logger) Log(message string, level LogLevel) {
 	}
 }
 
-func (l *Logger) Debug(message string) {
-	l.Log(message, LogDebug)
+// formatLogLine formats event as a line of the log file, as plain text or as a
+// JSON object, depending on the config.
+func formatLogLine(event LogEvent, config *Config) ([]byte, error) {
+	if config != nil && config.LogFormat == logFormatJSON {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return nil, fmt.Errorf("failed to format log entry: %v", err)
+		}
+		return append(line, '\n'), nil
+	}
+	return []byte(fmt.Sprintf("%s %s %s\n", event.Timestamp.Format(logTimeLayout), event.Level, event.text())), nil
+}
+
+// text returns the message followed by the fields as key=value pairs.
+func (e LogEvent) text() string {
+	if len(e.Fields) == 0 {
+		return e.Message
+	}
+	keys := make([]string, 0, len(e.Fields))
+	for key := range e.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(e.Message)
+	for _, key := range keys {
+		value := fmt.Sprint(e.Fields[key])
+		if value == "" || strings.ContainsAny(value, " =\"\n") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", key, value)
+	}
+	return b.String()
+}
+
+// newLogFields pairs up alternating keys and values. Values are converted to
+// something that reads well both as text and as JSON.
+func newLogFields(args []any) map[string]any {
+	if len(args) == 0 {
+		return nil
+	}
+	fields := make(map[string]any, (len(args)+1)/2)
+	for i := 0; i < len(args); i++ {
+		key, ok := args[i].(string)
+		if !ok || i+1 == len(args) {
+			fields[badFieldKey] = logFieldValue(args[i])
+			continue
+		}
+		fields[key] = logFieldValue(args[i+1])
+		i++
+	}
+	return fields
+}
+
+func logFieldValue(value any) any {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		// Also covers time.Duration, which JSON would write as nanoseconds
+		return v.String()
+	default:
+		return v
+	}
+}
+
+func (l *Logger) Debug(message string, fields ...any) {
+	l.Log(message, LogDebug, fields...)
 }
 
-func (l *Logger) Error(message string) {
-	l.Log(message, LogErrors)
+func (l *Logger) Info(message string, fields ...any) {
+	l.Log(message, LogInfo, fields...)
+}
+
+func (l *Logger) Warn(message string, fields ...any) {
+	l.Log(message, LogWarn, fields...)
+}
+
+func (l *Logger) Error(message string, fields ...any) {
+	l.Log(message, LogErrors, fields...)
 }
 
 func (l *Logger) Close() {
 	if l.elog != nil {
 		l.elog.Close()
 	}
+	l.file.Close()
+}
+
+// Query returns a page of the entries in the log file and its rotated files.
+func (l *Logger) Query(q logQuery) (logPage, error) {
+	return l.file.query(q)
 }
 
 func getLogLevel(level string) LogLevel {
 	switch strings.ToLower(level) {
 	case "debug":
 		return LogDebug
+	case "info":
+		return LogInfo
+	case "warn":
+		return LogWarn
 	case "errors":
 		return LogErrors
 	default:
@@ -122,10 +242,30 @@ func getLogLevel(level string) LogLevel {
 	}
 }
 
+// parseLogLevel parses a level as written by LogLevel.String.
+func parseLogLevel(level string) (LogLevel, bool) {
+	switch level {
+	case "debug":
+		return LogDebug, true
+	case "info":
+		return LogInfo, true
+	case "warn":
+		return LogWarn, true
+	case "error":
+		return LogErrors, true
+	default:
+		return LogOff, false
+	}
+}
+
 func (l LogLevel) String() string {
 	switch l {
 	case LogDebug:
 		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
 	case LogErrors:
 		return "error"
 	default:
@@ -0,0 +1,130 @@
+package bgService
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// discardLogger is a common.Logger that drops every message.
+type discardLogger struct{}
+
+func (discardLogger) Debug(message string, fields ...any) {}
+func (discardLogger) Info(message string, fields ...any)  {}
+func (discardLogger) Warn(message string, fields ...any)  {}
+func (discardLogger) Error(message string, fields ...any) {}
+func (discardLogger) Close()                              {}
+
+// recordingSystemLog is a systemLog that keeps every message by severity.
+type recordingSystemLog struct {
+	mu       sync.Mutex
+	messages map[string][]string
+}
+
+func (r *recordingSystemLog) record(severity, msg string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.messages == nil {
+		r.messages = make(map[string][]string)
+	}
+	r.messages[severity] = append(r.messages[severity], msg)
+	return nil
+}
+
+func (r *recordingSystemLog) Info(eid uint32, msg string) error    { return r.record("info", msg) }
+func (r *recordingSystemLog) Warning(eid uint32, msg string) error { return r.record("warning", msg) }
+func (r *recordingSystemLog) Error(eid uint32, msg string) error   { return r.record("error", msg) }
+func (r *recordingSystemLog) Close() error                         { return nil }
+
+func newTestLogger(t *testing.T, config Config) (*Logger, *recordingSystemLog, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "service.log")
+	elog := &recordingSystemLog{}
+	l := &Logger{file: newLogFile(path), config: func() Config { return config }, elog: elog}
+	t.Cleanup(l.Close)
+	return l, elog, path
+}
+
+func TestLoggerLevels(t *testing.T) {
+	l, elog, path := newTestLogger(t, Config{LogLevel: "info"})
+	l.Debug("debug message")
+	l.Info("info message", "broker", "tcp://localhost:1883")
+	l.Warn("warn message")
+	l.Error("error message", "err", errors.New("failed"))
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var levels []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		entry, ok := parseLogLine(line, "service.log")
+		if !ok {
+			t.Fatalf("line %q doesn't parse", line)
+		}
+		levels = append(levels, entry.Level)
+	}
+	if want := []string{"info", "warn", "error"}; !reflect.DeepEqual(levels, want) {
+		t.Errorf("levels = %v, want %v", levels, want)
+	}
+
+	want := map[string][]string{
+		"info":    {"info message broker=tcp://localhost:1883"},
+		"warning": {"warn message"},
+		"error":   {"error message err=failed"},
+	}
+	if !reflect.DeepEqual(elog.messages, want) {
+		t.Errorf("system log = %v, want %v", elog.messages, want)
+	}
+}
+
+func TestLoggerJSONFormat(t *testing.T) {
+	l, _, path := newTestLogger(t, Config{LogLevel: "debug", LogFormat: logFormatJSON})
+	l.Info("Script finished", "command", "backup", "duration", 1500*time.Millisecond, "exit_code", 0)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event map[string]any
+	if err := json.Unmarshal(content, &event); err != nil {
+		t.Fatalf("line %q isn't JSON: %v", content, err)
+	}
+	want := map[string]any{"command": "backup", "duration": "1.5s", "exit_code": float64(0)}
+	if event["message"] != "Script finished" || event["level"] != "info" || !reflect.DeepEqual(event["fields"], want) {
+		t.Errorf("event = %v", event)
+	}
+
+	entry, ok := parseLogLine(strings.TrimSpace(string(content)), "service.log")
+	if !ok || entry.Message != "Script finished" || entry.Level != "info" {
+		t.Errorf("parsed entry = %+v, %v", entry, ok)
+	}
+}
+
+func TestLogEventText(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []any
+		text   string
+	}{
+		{name: "no fields", text: "message"},
+		{name: "sorted by key", fields: []any{"b", 2, "a", 1}, text: "message a=1 b=2"},
+		{name: "quoted values", fields: []any{"path", `C:\My Scripts`, "empty", ""}, text: `message empty="" path="C:\\My Scripts"`},
+		{name: "value without key", fields: []any{"command", "backup", 42}, text: "message !BADKEY=42 command=backup"},
+		{name: "non-string key", fields: []any{1, "x"}, text: "message !BADKEY=x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := LogEvent{Message: "message", Fields: newLogFields(tt.fields)}
+			if text := event.text(); text != tt.text {
+				t.Errorf("text = %q, want %q", text, tt.text)
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package bgService
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLogQueryLimit = 100
+	maxLogQueryLimit     = 1000
+)
+
+// logQuery selects log entries, newest first. A zero field doesn't filter.
+type logQuery struct {
+	// Level is the least severe level to return
+	Level LogLevel
+	Since time.Time
+	Until time.Time
+	// Text is matched case-insensitively against the message and its fields
+	Text   string
+	Limit  int
+	Cursor logCursor
+}
+
+// logCursor points just past the last entry of a page. Timestamps only have
+// second precision, so it also counts the entries of that second that were
+// already returned.
+type logCursor struct {
+	Timestamp time.Time
+	Skip      int
+}
+
+func (c logCursor) String() string {
+	return fmt.Sprintf("%d.%d", c.Timestamp.Unix(), c.Skip)
+}
+
+func parseLogCursor(s string) (logCursor, error) {
+	seconds, skip, found := strings.Cut(s, ".")
+	if !found {
+		return logCursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	unix, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return logCursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	n, err := strconv.Atoi(skip)
+	if err != nil || n < 0 {
+		return logCursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	return logCursor{Timestamp: time.Unix(unix, 0), Skip: n}, nil
+}
+
+type logPage struct {
+	Entries    []LogEvent `json:"entries"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+func (q logQuery) matches(entry LogEvent) bool {
+	if q.Level != LogOff {
+		level, ok := parseLogLevel(entry.Level)
+		if !ok || level > q.Level {
+			return false
+		}
+	}
+	if !q.Since.IsZero() && entry.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && entry.Timestamp.After(q.Until) {
+		return false
+	}
+	return q.Text == "" || strings.Contains(strings.ToLower(entry.text()), strings.ToLower(q.Text))
+}
+
+// logPager fills one page of a query from entries fed to it newest first.
+type logPager struct {
+	q    logQuery
+	page logPage
+	// skipped counts the entries of the cursor's second skipped so far
+	skipped int
+	last    logCursor
+	done    bool
+}
+
+func newLogPager(q logQuery) *logPager {
+	return &logPager{q: q, page: logPage{Entries: []LogEvent{}}}
+}
+
+// add takes the next older entry and reports whether more are needed.
+func (pg *logPager) add(entry LogEvent) bool {
+	q := pg.q
+	if !q.Since.IsZero() && entry.Timestamp.Before(q.Since) {
+		// Every entry after this one is older still
+		pg.done = true
+		return false
+	}
+	if !q.matches(entry) {
+		return true
+	}
+	if !q.Cursor.Timestamp.IsZero() {
+		second := entry.Timestamp.Unix()
+		if second > q.Cursor.Timestamp.Unix() {
+			return true
+		}
+		if second == q.Cursor.Timestamp.Unix() && pg.skipped < q.Cursor.Skip {
+			pg.skipped++
+			return true
+		}
+	}
+	if len(pg.page.Entries) == q.Limit {
+		pg.page.NextCursor = pg.last.String()
+		pg.done = true
+		return false
+	}
+	pg.page.Entries = append(pg.page.Entries, entry)
+	if entry.Timestamp.Unix() == pg.last.Timestamp.Unix() {
+		pg.last.Skip++
+	} else {
+		pg.last = logCursor{Timestamp: entry.Timestamp, Skip: 1}
+	}
+	if entry.Timestamp.Unix() == q.Cursor.Timestamp.Unix() && pg.last.Skip == 1 {
+		// Count the entries of the cursor's second skipped on earlier pages
+		pg.last.Skip += q.Cursor.Skip
+	}
+	return true
+}
+
+// wanted returns how many more entries the page can take, counting the one
+// that tells whether there is a next page and those the cursor skips.
+func (pg *logPager) wanted() int {
+	return pg.q.Limit - len(pg.page.Entries) + 1 + pg.q.Cursor.Skip - pg.skipped
+}
+
+// query reads the current and the rotated log files, newest first, and returns
+// one page of the entries that match q. It stops reading as soon as the page
+// is full, so the first pages only touch the end of the current file.
+func (f *logFile) query(q logQuery) (logPage, error) {
+	// Keep cleanup from compressing or removing the files while they are read
+	f.cleanupMu.Lock()
+	defer f.cleanupMu.Unlock()
+
+	// Open the current file and list the rotated ones together, so a rotation
+	// in between can't hide or repeat a file
+	f.mu.Lock()
+	rotated, err := f.rotatedFiles()
+	if err != nil {
+		f.mu.Unlock()
+		return logPage{}, fmt.Errorf("failed to list rotated log files: %v", err)
+	}
+	current, err := os.Open(f.path)
+	f.mu.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return logPage{}, fmt.Errorf("failed to open log file: %v", err)
+	}
+
+	pager := newLogPager(q)
+	if current != nil {
+		err := readLogEntriesReverse(current, filepath.Base(f.path), pager.add)
+		current.Close()
+		if err != nil {
+			return logPage{}, fmt.Errorf("failed to read log file: %v", err)
+		}
+	}
+
+	for i := len(rotated) - 1; i >= 0 && !pager.done; i-- {
+		// A file is rotated after its last entry was written, so it and the
+		// files before it can't have entries after since
+		if rotatedAt, ok := f.rotatedAt(rotated[i]); ok && !q.Since.IsZero() && rotatedAt.Before(q.Since) {
+			break
+		}
+		if err := readRotatedLogFile(rotated[i], pager); err != nil {
+			return logPage{}, fmt.Errorf("failed to read %s: %v", rotated[i], err)
+		}
+	}
+	return pager.page, nil
+}
+
+// rotatedAt returns the time in the name of a rotated log file.
+func (f *logFile) rotatedAt(path string) (time.Time, bool) {
+	ext := filepath.Ext(f.path)
+	name := strings.TrimSuffix(filepath.Base(path), ".gz")
+	name = strings.TrimSuffix(name, ext)
+	name = strings.TrimPrefix(name, strings.TrimSuffix(filepath.Base(f.path), ext)+"-")
+	rotatedAt, err := time.ParseInLocation(rotatedTimeLayout, name, time.Local)
+	return rotatedAt, err == nil
+}
+
+func readRotatedLogFile(path string, pager *logPager) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	source := filepath.Base(path)
+	if !strings.HasSuffix(path, ".gz") {
+		return readLogEntriesReverse(file, source, pager.add)
+	}
+
+	// gzip can only be read from the start. Keep just the newest entries that
+	// can still end up on the page, so memory stays bounded by the page size.
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	wanted := pager.wanted()
+	var newest []LogEvent
+	err = readLogEntries(gz, source, func(entry LogEvent) {
+		cursor := pager.q.Cursor.Timestamp
+		if !pager.q.matches(entry) || (!cursor.IsZero() && entry.Timestamp.Unix() > cursor.Unix()) {
+			return
+		}
+		newest = append(newest, entry)
+		if len(newest) > wanted {
+			newest = newest[1:]
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(newest) - 1; i >= 0; i-- {
+		if !pager.add(newest[i]) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readLogEntries parses a log file from the start and calls fn for each entry,
+// oldest first. Lines that don't start with a timestamp, such as script output,
+// continue the entry before them. Lines written before the level was logged
+// have no level. In text lines the fields stay part of the message.
+func readLogEntries(r io.Reader, source string, fn func(LogEvent)) error {
+	var pending *LogEvent
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			line = strings.TrimRight(line, "\r\n")
+			if entry, ok := parseLogLine(line, source); ok {
+				if pending != nil {
+					fn(*pending)
+				}
+				pending = &entry
+			} else if pending != nil {
+				pending.Message += "\n" + line
+			}
+		}
+		if err == io.EOF {
+			if pending != nil {
+				fn(*pending)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// reverseReadSize is how much of a log file readLogEntriesReverse reads at once.
+const reverseReadSize = 64 * 1024
+
+// readLogEntriesReverse parses a log file from the end and calls fn for each
+// entry, newest first, until fn returns false. It parses the same entries as
+// readLogEntries.
+func readLogEntriesReverse(file *os.File, source string, fn func(LogEvent) bool) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// continuation holds the lines after an entry's first line, last one first,
+	// until the first line is reached
+	var continuation []string
+	emit := func(line string) bool {
+		entry, ok := parseLogLine(line, source)
+		if !ok {
+			continuation = append(continuation, line)
+			return true
+		}
+		for i := len(continuation) - 1; i >= 0; i-- {
+			entry.Message += "\n" + continuation[i]
+		}
+		continuation = continuation[:0]
+		return fn(entry)
+	}
+
+	offset := info.Size()
+	// partial is the start of a line whose beginning hasn't been read yet
+	var partial []byte
+	buf := make([]byte, reverseReadSize)
+	for offset > 0 {
+		n := int64(len(buf))
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+		if _, err := file.ReadAt(buf[:n], offset); err != nil && err != io.EOF {
+			return err
+		}
+		chunk := append(buf[:n:n], partial...)
+
+		for {
+			i := bytes.LastIndexByte(chunk, '\n')
+			if i < 0 {
+				break
+			}
+			line := strings.TrimRight(string(chunk[i+1:]), "\r")
+			chunk = chunk[:i]
+			if line == "" && len(continuation) == 0 && offset+int64(i)+1 == info.Size() {
+				// The newline that ends the file
+				continue
+			}
+			if !emit(line) {
+				return nil
+			}
+		}
+		partial = append([]byte(nil), chunk...)
+	}
+	if len(partial) > 0 {
+		emit(strings.TrimRight(string(partial), "\r"))
+	}
+	return nil
+}
+
+// parseLogLine parses a line written as text or as JSON.
+func parseLogLine(line, source string) (LogEvent, bool) {
+	if strings.HasPrefix(line, "{") {
+		var entry LogEvent
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.Timestamp.IsZero() {
+			return LogEvent{}, false
+		}
+		entry.Source = source
+		return entry, true
+	}
+
+	if len(line) <= len(logTimeLayout) || line[len(logTimeLayout)] != ' ' {
+		return LogEvent{}, false
+	}
+	timestamp, err := time.ParseInLocation(logTimeLayout, line[:len(logTimeLayout)], time.Local)
+	if err != nil {
+		return LogEvent{}, false
+	}
+
+	entry := LogEvent{Timestamp: timestamp, Message: line[len(logTimeLayout)+1:], Source: source}
+	if level, message, found := strings.Cut(entry.Message, " "); found {
+		if _, ok := parseLogLevel(level); ok {
+			entry.Level = level
+			entry.Message = message
+		}
+	}
+	return entry, true
+}
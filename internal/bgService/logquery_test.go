@@ -0,0 +1,237 @@
+package bgService
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLine(t *testing.T) {
+	at := time.Date(2026, 3, 10, 8, 30, 15, 0, time.Local)
+	tests := []struct {
+		name  string
+		line  string
+		entry LogEvent
+		ok    bool
+	}{
+		{
+			name:  "text with level",
+			line:  "2026/03/10 08:30:15 info Connected to broker broker=tcp://localhost:1883",
+			entry: LogEvent{Timestamp: at, Level: "info", Message: "Connected to broker broker=tcp://localhost:1883"},
+			ok:    true,
+		},
+		{
+			name:  "text without level",
+			line:  "2026/03/10 08:30:15 Service started",
+			entry: LogEvent{Timestamp: at, Message: "Service started"},
+			ok:    true,
+		},
+		{
+			name:  "JSON",
+			line:  `{"timestamp":"` + at.Format(time.RFC3339) + `","level":"error","message":"Script failed","fields":{"command":"backup"}}`,
+			entry: LogEvent{Timestamp: at, Level: "error", Message: "Script failed", Fields: map[string]any{"command": "backup"}},
+			ok:    true,
+		},
+		{name: "script output", line: "Copied 3 files"},
+		{name: "empty", line: ""},
+		{name: "timestamp only", line: "2026/03/10 08:30:15"},
+		{name: "invalid timestamp", line: "2026/13/10 08:30:15 info message"},
+		{name: "JSON without timestamp", line: `{"message":"no time"}`},
+		{name: "invalid JSON", line: `{"timestamp":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, ok := parseLogLine(tt.line, "service.log")
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			tt.entry.Source = "service.log"
+			if !entry.Timestamp.Equal(tt.entry.Timestamp) {
+				t.Errorf("timestamp = %s, want %s", entry.Timestamp, tt.entry.Timestamp)
+			}
+			entry.Timestamp = tt.entry.Timestamp
+			if !reflect.DeepEqual(entry, tt.entry) {
+				t.Errorf("entry = %+v, want %+v", entry, tt.entry)
+			}
+		})
+	}
+}
+
+func TestParseLogCursor(t *testing.T) {
+	tests := []struct {
+		cursor string
+		want   logCursor
+		err    bool
+	}{
+		{cursor: "1773131415.0", want: logCursor{Timestamp: time.Unix(1773131415, 0)}},
+		{cursor: "1773131415.3", want: logCursor{Timestamp: time.Unix(1773131415, 0), Skip: 3}},
+		{cursor: "1773131415", err: true},
+		{cursor: "abc.1", err: true},
+		{cursor: "1773131415.x", err: true},
+		{cursor: "1773131415.-1", err: true},
+		{cursor: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cursor, func(t *testing.T) {
+			cursor, err := parseLogCursor(tt.cursor)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("cursor = %+v, want an error", cursor)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cursor.Timestamp.Equal(tt.want.Timestamp) || cursor.Skip != tt.want.Skip {
+				t.Errorf("cursor = %+v, want %+v", cursor, tt.want)
+			}
+			if cursor.String() != tt.cursor {
+				t.Errorf("String() = %q, want %q", cursor.String(), tt.cursor)
+			}
+		})
+	}
+}
+
+// writeTestLogs writes a gzipped and a plain rotated log file, each named after
+// its last entry, and the current log file. There are three entries per second
+// and multi-line entries that span more than one read of
+// readLogEntriesReverse. It returns the number of entries written.
+func writeTestLogs(t *testing.T, path string, start time.Time) int {
+	t.Helper()
+	n := 0
+	entries := func(count int) []byte {
+		var b bytes.Buffer
+		for i := 0; i < count; i++ {
+			at := start.Add(time.Duration(n/3) * time.Second)
+			fmt.Fprintf(&b, "%s %s entry %d\n", at.Format(logTimeLayout), []string{"debug", "info", "error"}[n%3], n)
+			if n%7 == 0 {
+				b.WriteString("output\r\n" + strings.Repeat("x", reverseReadSize+100) + "\n")
+			}
+			n++
+		}
+		return b.Bytes()
+	}
+
+	base := strings.TrimSuffix(path, ".log")
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(entries(50))
+	w.Close()
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{base + "-20260310-080017.000.log.gz", gz.Bytes()},
+		{base + "-20260310-080034.000.log", entries(50)},
+		{path, entries(50)},
+	}
+	for _, file := range files {
+		if err := os.WriteFile(file.name, file.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return n
+}
+
+func TestLogFileQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.log")
+	start := time.Date(2026, 3, 10, 8, 0, 0, 0, time.Local)
+	total := writeTestLogs(t, path, start)
+	f := newLogFile(path)
+
+	all, err := f.query(logQuery{Limit: maxLogQueryLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Entries) != total || all.NextCursor != "" {
+		t.Fatalf("got %d entries and cursor %q, want %d and none", len(all.Entries), all.NextCursor, total)
+	}
+	for i, entry := range all.Entries {
+		want := fmt.Sprintf("entry %d", total-1-i)
+		if first, _, _ := strings.Cut(entry.Message, "\n"); first != want {
+			t.Fatalf("entry %d is %q, want %q", i, first, want)
+		}
+	}
+	if want := "entry 147\noutput\n" + strings.Repeat("x", reverseReadSize+100); all.Entries[2].Message != want {
+		t.Errorf("multi-line entry has %d bytes, want %d", len(all.Entries[2].Message), len(want))
+	}
+	if source := all.Entries[total-1].Source; source != "service-20260310-080017.000.log.gz" {
+		t.Errorf("oldest entry is from %q", source)
+	}
+
+	queries := []struct {
+		name  string
+		query logQuery
+		count int
+	}{
+		{name: "all", query: logQuery{}, count: total},
+		{name: "level", query: logQuery{Level: LogInfo}, count: total * 2 / 3},
+		{name: "text", query: logQuery{Text: "ENTRY 1"}, count: 61},
+		{name: "since", query: logQuery{Since: start.Add(10 * time.Second)}, count: total - 30},
+		{name: "until", query: logQuery{Until: start.Add(9 * time.Second)}, count: 30},
+	}
+	for _, q := range queries {
+		for _, limit := range []int{1, 2, 3, 7, 40} {
+			t.Run(fmt.Sprintf("%s/limit %d", q.name, limit), func(t *testing.T) {
+				var got []LogEvent
+				query := q.query
+				query.Limit = limit
+				for pages := 0; ; pages++ {
+					if pages > total {
+						t.Fatal("cursor doesn't advance")
+					}
+					page, err := f.query(query)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(page.Entries) > limit {
+						t.Fatalf("page has %d entries, limit is %d", len(page.Entries), limit)
+					}
+					got = append(got, page.Entries...)
+					if page.NextCursor == "" {
+						break
+					}
+					if query.Cursor, err = parseLogCursor(page.NextCursor); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if len(got) != q.count {
+					t.Fatalf("got %d entries, want %d", len(got), q.count)
+				}
+				query.Limit = maxLogQueryLimit
+				query.Cursor = logCursor{}
+				want, err := f.query(query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := range got {
+					if got[i].Message != want.Entries[i].Message {
+						t.Fatalf("entry %d of the pages differs from a single query", i)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestLogFileQueryMissingFile(t *testing.T) {
+	f := newLogFile(filepath.Join(t.TempDir(), "service.log"))
+	page, err := f.query(logQuery{Limit: defaultLogQueryLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 0 || page.NextCursor != "" {
+		t.Errorf("page = %+v, want no entries", page)
+	}
+}
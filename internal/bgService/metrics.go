@@ -0,0 +1,194 @@
+package bgService
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// sensorMetricsMaxAge is how long collected sensor values are reused between
+// scrapes. Collecting them takes over a second, mostly for the CPU usage.
+const sensorMetricsMaxAge = 10 * time.Second
+
+// serviceMetrics holds the Prometheus metrics served on /metrics. It uses its
+// own registry so only the metrics defined here, plus the Go runtime ones, are
+// exposed.
+type serviceMetrics struct {
+	registry       *prometheus.Registry
+	mqttConnects   prometheus.Counter
+	mqttReconnects prometheus.Counter
+	mqttLost       prometheus.Counter
+	commands       *prometheus.CounterVec
+	scriptDuration *prometheus.HistogramVec
+
+	mu        sync.Mutex
+	connected bool
+}
+
+func newServiceMetrics(p *program) *serviceMetrics {
+	m := &serviceMetrics{
+		registry: prometheus.NewRegistry(),
+		mqttConnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "winsense_mqtt_connects_total",
+			Help: "Number of successful connections to the MQTT broker.",
+		}),
+		mqttReconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "winsense_mqtt_reconnects_total",
+			Help: "Number of connections to the MQTT broker after the first one.",
+		}),
+		mqttLost: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "winsense_mqtt_connection_lost_total",
+			Help: "Number of times the connection to the MQTT broker was lost.",
+		}),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "winsense_commands_total",
+			Help: "Number of finished command runs by command and status.",
+		}, []string{"command", "status"}),
+		scriptDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "winsense_script_duration_seconds",
+			Help:    "Duration of script runs by command.",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"command"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.mqttConnects,
+		m.mqttReconnects,
+		m.mqttLost,
+		m.commands,
+		m.scriptDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "winsense_mqtt_connected",
+			Help: "Whether the service is connected to the MQTT broker (1) or not (0).",
+		}, func() float64 {
+			if client := p.currentMQTTClient(); client != nil && client.IsConnected() {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "winsense_sse_clients",
+			Help: "Number of clients connected to the /api/events stream.",
+		}, func() float64 {
+			p.eventMutex.Lock()
+			defer p.eventMutex.Unlock()
+			return float64(len(p.eventChannels))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "winsense_scripts_running",
+			Help: "Number of scripts currently running.",
+		}, func() float64 {
+			return float64(p.executor.Status().Running)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "winsense_scripts_queued",
+			Help: "Number of script runs waiting to start.",
+		}, func() float64 {
+			return float64(p.executor.Status().Queued)
+		}),
+		newSensorMetricsCollector(),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *serviceMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// mqttConnected records a successful broker connection.
+func (m *serviceMetrics) mqttConnected() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.connected {
+		m.mqttReconnects.Inc()
+	}
+	m.connected = true
+	m.mqttConnects.Inc()
+}
+
+// mqttConnectionLost records a lost broker connection.
+func (m *serviceMetrics) mqttConnectionLost() {
+	m.mqttLost.Inc()
+}
+
+// scriptRunFinished records the outcome of a script run.
+func (m *serviceMetrics) scriptRunFinished(run *ScriptRun) {
+	m.commands.WithLabelValues(run.Command, run.Status).Inc()
+	if run.Status != runStatusRejected && !run.EndedAt.IsZero() {
+		m.scriptDuration.WithLabelValues(run.Command).Observe(run.EndedAt.Sub(run.StartedAt).Seconds())
+	}
+}
+
+// sensorMetricsCollector exposes the values from collectSensorData, reusing
+// them for sensorMetricsMaxAge so frequent scrapes don't keep the CPU busy.
+type sensorMetricsCollector struct {
+	mu          sync.Mutex
+	data        SensorData
+	collectedAt time.Time
+
+	cpuUsage       *prometheus.Desc
+	memoryUsage    *prometheus.Desc
+	diskUsage      *prometheus.Desc
+	uptime         *prometheus.Desc
+	cpuTemperature *prometheus.Desc
+	temperature    *prometheus.Desc
+}
+
+func newSensorMetricsCollector() *sensorMetricsCollector {
+	return &sensorMetricsCollector{
+		cpuUsage:       prometheus.NewDesc("winsense_cpu_usage_percent", "CPU usage of the host.", nil, nil),
+		memoryUsage:    prometheus.NewDesc("winsense_memory_usage_percent", "Memory usage of the host.", nil, nil),
+		diskUsage:      prometheus.NewDesc("winsense_disk_usage_percent", "Usage of the system disk.", nil, nil),
+		uptime:         prometheus.NewDesc("winsense_uptime_seconds", "Uptime of the host.", nil, nil),
+		cpuTemperature: prometheus.NewDesc("winsense_cpu_temperature_celsius", "CPU temperature of the host.", nil, nil),
+		temperature:    prometheus.NewDesc("winsense_temperature_celsius", "Temperature reported by a hardware sensor.", []string{"sensor"}, nil),
+	}
+}
+
+func (c *sensorMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpuUsage
+	ch <- c.memoryUsage
+	ch <- c.diskUsage
+	ch <- c.uptime
+	ch <- c.cpuTemperature
+	ch <- c.temperature
+}
+
+func (c *sensorMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	if time.Since(c.collectedAt) > sensorMetricsMaxAge {
+		if data, err := collectSensorData(); err == nil {
+			c.data = data
+			c.collectedAt = time.Now()
+		}
+	}
+	data := c.data
+	c.mu.Unlock()
+
+	if data.Timestamp.IsZero() {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.cpuUsage, prometheus.GaugeValue, data.CPUUsage)
+	ch <- prometheus.MustNewConstMetric(c.memoryUsage, prometheus.GaugeValue, data.MemoryUsage)
+	ch <- prometheus.MustNewConstMetric(c.diskUsage, prometheus.GaugeValue, data.DiskUsage)
+	ch <- prometheus.MustNewConstMetric(c.uptime, prometheus.GaugeValue, float64(data.Uptime))
+	// Zero means the temperature isn't available on this host
+	if data.CPUTemperature != 0 {
+		ch <- prometheus.MustNewConstMetric(c.cpuTemperature, prometheus.GaugeValue, data.CPUTemperature)
+	}
+	seen := make(map[string]bool)
+	for _, sensor := range data.Sensors {
+		if seen[sensor.SensorKey] {
+			continue
+		}
+		seen[sensor.SensorKey] = true
+		ch <- prometheus.MustNewConstMetric(c.temperature, prometheus.GaugeValue, sensor.Temperature, sensor.SensorKey)
+	}
+}
@@ -0,0 +1,49 @@
+package bgService
+
+import (
+	"errors"
+	"testing"
+)
+
+// counterValue returns the value of the counter called name, as /metrics
+// exposes it.
+func counterValue(t *testing.T, p *program, name string) float64 {
+	t.Helper()
+	families, err := p.metrics.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == name && len(family.GetMetric()) == 1 {
+			return family.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	t.Fatalf("no counter %s", name)
+	return 0
+}
+
+func TestMQTTReconnectMetrics(t *testing.T) {
+	p, client := newTestProgram(t, Config{BrokerAddress: "tcp://localhost:1883", ClientID: "office", Topic: "home"})
+	check := func(connects, reconnects, lost float64) {
+		t.Helper()
+		for name, want := range map[string]float64{
+			"winsense_mqtt_connects_total":        connects,
+			"winsense_mqtt_reconnects_total":      reconnects,
+			"winsense_mqtt_connection_lost_total": lost,
+		} {
+			if got := counterValue(t, p, name); got != want {
+				t.Errorf("%s = %v, want %v", name, got, want)
+			}
+		}
+	}
+
+	p.onConnect(client)
+	check(1, 0, 0)
+
+	p.onConnectionLost(client, errors.New("connection reset by peer"))
+	p.onConnect(client)
+	check(2, 1, 1)
+
+	p.onConnect(client)
+	check(3, 2, 1)
+}
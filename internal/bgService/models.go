@@ -10,3 +10,14 @@ type ScriptConfig = common.ScriptConfig
 type ScriptConfigs = common.ScriptConfigs
 type SensorConfig = common.SensorConfig
 type SensorConfigs = common.SensorConfigs
+type ScriptRun = common.ScriptRun
+type ScriptRuns = common.ScriptRuns
+type ScriptRunFilter = common.ScriptRunFilter
+type Schedule = common.Schedule
+type Schedules = common.Schedules
+type SensorRule = common.SensorRule
+type SensorRules = common.SensorRules
+type User = common.User
+type Session = common.Session
+type APIToken = common.APIToken
+type APITokens = common.APITokens
@@ -1,19 +1,27 @@
 package bgService
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"path/filepath"
+	"os"
 	"runtime/debug"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-var (
-	topicBase           = "winsense/"
-	configTopic         = ""
-	configResponseTopic = ""
-)
+var topicBase = "winsense/"
+
+// commandTopic returns the topic the service receives commands on.
+func commandTopic(config Config) string {
+	return topicBase + config.Topic + "/" + config.ClientID
+}
+
+// responseTopic returns the topic command responses are published to.
+func responseTopic(config Config) string {
+	return commandTopic(config) + "/response"
+}
 
 func (p *program) onConnect(client mqtt.Client) {
 	defer func() {
@@ -22,31 +30,41 @@ func (p *program) onConnect(client mqtt.Client) {
 		}
 	}()
 
-	p.Logger.Debug("Connected to MQTT broker")
-
-	// Set topics
-	configTopic = topicBase + p.config.Topic + "/" + p.config.ClientID
-	configResponseTopic = topicBase + p.config.Topic + "/" + p.config.ClientID + "/response"
+	config := p.currentConfig()
+	p.Logger.Info("Connected to MQTT broker", "broker", config.BrokerAddress)
+	p.metrics.mqttConnected()
+	p.mqttState.connected()
 
 	// Subscribe to the command topic
-	if token := client.Subscribe(configTopic, 0, p.commandHandler); token.Wait() && token.Error() != nil {
+	if token := client.Subscribe(commandTopic(config), 0, p.commandHandler); token.Wait() && token.Error() != nil {
 		errMsg := fmt.Sprintf("Failed to subscribe to command topic: %v", token.Error())
 		p.Logger.Error(errMsg)
 	} else {
-		p.Logger.Debug(fmt.Sprintf("Successfully subscribed to command topic: %s", configTopic))
+		p.Logger.Debug(fmt.Sprintf("Successfully subscribed to command topic: %s", commandTopic(config)))
 	}
 
 	// Subscribe to the response topic
-	if token := client.Subscribe(configResponseTopic, 0, p.responseHandler); token.Wait() && token.Error() != nil {
+	if token := client.Subscribe(responseTopic(config), 0, p.responseHandler); token.Wait() && token.Error() != nil {
 		errMsg := fmt.Sprintf("Failed to subscribe to response topic: %v", token.Error())
 		p.Logger.Error(errMsg)
 	} else {
-		p.Logger.Debug(fmt.Sprintf("Successfully subscribed to response topic: %s", configResponseTopic))
+		p.Logger.Debug(fmt.Sprintf("Successfully subscribed to response topic: %s", responseTopic(config)))
 	}
+
+	// Mark this PC as online; the broker publishes the offline payload for us if
+	// the connection drops without a clean disconnect
+	p.publishAvailability(client, p.payloadOnline())
+
+	// Announce commands to Home Assistant and clean up deleted ones
+	p.publishDiscovery(client)
+	p.subscribeDiscovery(client)
 }
 
 func (p *program) onConnectionLost(client mqtt.Client, err error) {
-	p.Logger.Error(fmt.Sprintf("Connection to MQTT broker lost: %v", err))
+	// The client reconnects by itself
+	p.Logger.Warn("Connection to MQTT broker lost", "broker", p.currentConfig().BrokerAddress, "error", err)
+	p.metrics.mqttConnectionLost()
+	p.mqttState.lost(err)
 }
 
 func (p *program) commandHandler(client mqtt.Client, msg mqtt.Message) {
@@ -56,73 +74,215 @@ func (p *program) commandHandler(client mqtt.Client, msg mqtt.Message) {
 		}
 	}()
 
-	command := string(msg.Payload())
-	p.Logger.Debug(fmt.Sprintf("Received command: %s", command))
+	req, isEnvelope, err := parseCommandPayload(msg.Payload())
+	legacy := !isEnvelope && p.currentConfig().LegacyResponses
+	if err != nil {
+		errMsg := fmt.Sprintf("Invalid command payload: %v", err)
+		p.Logger.Error(errMsg)
+		p.publishResponse(client, newCommandResponse(req, nil, runStatusInvalid, errMsg), legacy)
+		return
+	}
+	req.Source = runSourceMQTT
+	command := req.Command
+	p.Logger.Debug("Received command", "command", command, "topic", msg.Topic(), "request_id", req.RequestID)
 
-	scriptConfig, exists := p.config.Commands[command]
-	if !exists {
-		p.Logger.Error(fmt.Sprintf("Unknown command: %s", command))
+	if command == cancelCommand {
+		p.handleCancelCommand(client, req, legacy)
 		return
 	}
 
-	scriptPath := filepath.Join(p.scriptDir, scriptConfig.ScriptPath)
-	p.Logger.Debug(fmt.Sprintf("Executing script: %s", scriptPath))
+	run, err := p.runScript(req)
+	if errors.Is(err, errUnknownCommand) {
+		errMsg := fmt.Sprintf("Unknown command: %s", command)
+		p.Logger.Error(errMsg)
+		if !legacy {
+			p.publishResponse(client, newCommandResponse(req, nil, runStatusUnknown, errMsg), legacy)
+		}
+		return
+	}
+	if errors.Is(err, errInvalidRequest) {
+		errMsg := fmt.Sprintf("Invalid request for command '%s': %v", command, err)
+		p.Logger.Error(errMsg)
+		p.publishResponse(client, newCommandResponse(req, nil, runStatusInvalid, errMsg), legacy)
+		return
+	}
 
-	output, err := p.executeScript(scriptPath, scriptConfig.RunAsUser)
-	if err != nil {
+	if errors.Is(err, errScriptTimeout) {
+		errMsg := fmt.Sprintf("Script for command '%s' timed out after %s", command, p.scriptTimeout(p.currentConfig().Commands[command]))
+		p.Logger.Error(errMsg)
+		p.publishResponse(client, newCommandResponse(req, run, run.Status, errMsg), legacy)
+	} else if errors.Is(err, errCommandBusy) {
+		errMsg := fmt.Sprintf("Command '%s' rejected: it is already running", command)
+		p.Logger.Debug(errMsg)
+		p.publishResponse(client, newCommandResponse(req, run, run.Status, errMsg), legacy)
+	} else if errors.Is(err, errRunCancelled) {
+		errMsg := fmt.Sprintf("Script for command '%s' was cancelled", command)
+		p.Logger.Debug(errMsg)
+		p.publishResponse(client, newCommandResponse(req, run, run.Status, errMsg), legacy)
+	} else if err != nil {
 		errMsg := fmt.Sprintf("Error executing script for command '%s': %v", command, err)
 		p.Logger.Error(errMsg)
-		p.publishResponse(client, errMsg)
+		p.publishResponse(client, newCommandResponse(req, run, run.Status, errMsg), legacy)
 	} else {
-		p.Logger.Debug(fmt.Sprintf("Successfully executed command: %s\nOutput: %s", command, output))
-		p.publishResponse(client, output)
+		p.Logger.Debug(fmt.Sprintf("Successfully executed command: %s\nOutput: %s", command, run.Stdout))
+		p.publishResponse(client, newCommandResponse(req, run, run.Status, ""), legacy)
 	}
 }
 
+// handleCancelCommand cancels the runs selected by a cancel request. The
+// cancelled runs publish their own response with status cancelled when they
+// finish; this one only reports whether anything was cancelled.
+func (p *program) handleCancelCommand(client mqtt.Client, req scriptRequest, legacy bool) {
+	cancelled, err := p.cancelScriptRuns(req)
+	if errors.Is(err, errRunNotFound) {
+		errMsg := fmt.Sprintf("Cancel failed: %v", err)
+		p.Logger.Debug(errMsg)
+		p.publishResponse(client, newCommandResponse(req, nil, runStatusUnknown, errMsg), legacy)
+		return
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Invalid cancel request: %v", err)
+		p.Logger.Error(errMsg)
+		p.publishResponse(client, newCommandResponse(req, nil, runStatusInvalid, errMsg), legacy)
+		return
+	}
+
+	response := newCommandResponse(req, nil, runStatusSuccess, "")
+	response.ExitCode = 0
+	response.Stdout = fmt.Sprintf("cancelled %d run(s)", cancelled)
+	p.publishResponse(client, response, legacy)
+}
+
 func (p *program) responseHandler(client mqtt.Client, msg mqtt.Message) {
 	p.Logger.Debug(fmt.Sprintf("Received response: %s", string(msg.Payload())))
 }
 
-func (p *program) publishResponse(client mqtt.Client, message string) {
-	if token := client.Publish(configResponseTopic, 0, false, message); token.Wait() && token.Error() != nil {
+// commandResponse is the JSON document published on the response topic for
+// every command.
+type commandResponse struct {
+	Command    string    `json:"command"`
+	RequestID  string    `json:"request_id,omitempty"`
+	RunID      int64     `json:"run_id,omitempty"`
+	Status     string    `json:"status"`
+	ExitCode   int       `json:"exit_code"`
+	Stdout     string    `json:"stdout"`
+	Stderr     string    `json:"stderr"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Host       string    `json:"host"`
+}
+
+// newCommandResponse builds a response for req. run is nil when the request was
+// rejected before a script was started.
+func newCommandResponse(req scriptRequest, run *ScriptRun, status string, errMsg string) commandResponse {
+	host, _ := os.Hostname()
+	response := commandResponse{
+		Command:   req.Command,
+		RequestID: req.RequestID,
+		Status:    status,
+		ExitCode:  -1,
+		Error:     errMsg,
+		StartedAt: time.Now().UTC(),
+		Host:      host,
+	}
+	if run != nil {
+		response.RunID = run.ID
+		response.ExitCode = run.ExitCode
+		response.Stdout = run.Stdout
+		response.Stderr = run.Stderr
+		response.StartedAt = run.StartedAt
+		response.DurationMs = run.EndedAt.Sub(run.StartedAt).Milliseconds()
+	}
+	return response
+}
+
+// publishResponse publishes the outcome of a command as JSON. With legacy set,
+// only the script output or the error message is published as plain text, the
+// way responses looked before the JSON schema was introduced.
+func (p *program) publishResponse(client mqtt.Client, response commandResponse, legacy bool) {
+	var payload interface{}
+	if legacy {
+		if response.Error != "" {
+			payload = response.Error
+		} else {
+			payload = response.Stdout
+		}
+	} else {
+		jsonResponse, err := json.Marshal(response)
+		if err != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to marshal response: %v", err))
+			return
+		}
+		payload = jsonResponse
+	}
+
+	if token := client.Publish(responseTopic(p.currentConfig()), 0, false, payload); token.Wait() && token.Error() != nil {
 		p.Logger.Error(fmt.Sprintf("Failed to publish script output: %v", token.Error()))
 	}
 }
 
-func (p *program) publishSensorData() {
-	// TODO: Uncomment this when sensors are implemented
-	// Must be able to manage multiple sensors independently
+func (p *program) statusTopic() string {
+	return statusTopic(p.currentConfig())
+}
 
-	// ticker := time.NewTicker(time.Duration(p.config.SensorConfig.Interval) * time.Second)
-	// defer ticker.Stop()
+// statusTopic returns the availability topic of config, which defaults to one
+// below the command topic.
+func statusTopic(config Config) string {
+	if config.StatusTopic != "" {
+		return config.StatusTopic
+	}
+	return commandTopic(config) + "/status"
+}
 
-	// for range ticker.C {
-	// 	sensorData, err := collectSensorData()
-	// 	if err != nil {
-	// 		p.Logger.Error(fmt.Sprintf("Failed to collect sensor data: %v", err))
-	// 		continue
-	// 	}
+func (p *program) payloadOnline() string {
+	if payload := p.currentConfig().PayloadOnline; payload != "" {
+		return payload
+	}
+	return "online"
+}
 
-	// 	jsonData, err := json.Marshal(sensorData)
-	// 	if err != nil {
-	// 		p.Logger.Error(fmt.Sprintf("Failed to marshal sensor data: %v", err))
-	// 		continue
-	// 	}
+func (p *program) payloadOffline() string {
+	if payload := p.currentConfig().PayloadOffline; payload != "" {
+		return payload
+	}
+	return "offline"
+}
 
-	// 	token := p.mqttClient.Publish(p.config.SensorConfig.SensorTopic, 0, false, jsonData)
-	// 	if token.Wait() && token.Error() != nil {
-	// 		p.Logger.Error(fmt.Sprintf("Failed to publish sensor data: %v", token.Error()))
-	// 	} else {
-	// 		p.Logger.Debug("Successfully published sensor data")
-	// 	}
-	// }
+func (p *program) publishAvailability(client mqtt.Client, payload string) {
+	if token := client.Publish(p.statusTopic(), 1, true, payload); token.Wait() && token.Error() != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to publish availability '%s': %v", payload, token.Error()))
+	} else {
+		p.Logger.Debug(fmt.Sprintf("Published availability '%s' to %s", payload, p.statusTopic()))
+	}
 }
 
-func (p *program) setupMQTTClient() {
-	opts := mqtt.NewClientOptions().AddBroker(p.config.BrokerAddress)
-	opts.SetClientID(p.config.ClientID)
-	opts.SetUsername(p.config.Username)
-	opts.SetPassword(p.config.Password)
+// setupMQTTClient replaces the MQTT client with one for the current config. The
+// caller holds reloadMutex.
+func (p *program) setupMQTTClient() error {
+	config := p.currentConfig()
+	tlsConfig, err := newBrokerTLSConfig(config)
+	if err != nil {
+		return fmt.Errorf("invalid TLS configuration: %v", err)
+	}
+
+	// The password is only decrypted here, it stays encrypted in p.config
+	password, err := decryptSecret(config.Password)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt MQTT password: %v", err)
+	}
+
+	opts := mqtt.NewClientOptions().AddBroker(config.BrokerAddress)
+	opts.SetClientID(config.ClientID)
+	opts.SetUsername(config.Username)
+	opts.SetPassword(password)
+	opts.SetWill(statusTopic(config), p.payloadOffline(), 1, true)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	// Run every message handler in its own goroutine, so a long running script
+	// doesn't hold up other commands. The executor serializes them as needed.
+	opts.SetOrderMatters(false)
 	opts.SetOnConnectHandler(p.onConnect)
 	opts.SetConnectionLostHandler(p.onConnectionLost)
 
@@ -131,9 +291,6 @@ func (p *program) setupMQTTClient() {
 	opts.SetConnectRetry(true)
 	opts.SetConnectRetryInterval(time.Second * 10)
 
-	p.mqttClient = mqtt.NewClient(opts)
-
-	if p.config.SensorConfigEnabled {
-		go p.publishSensorData()
-	}
+	p.setMQTTClient(mqtt.NewClient(opts))
+	return nil
 }
@@ -0,0 +1,226 @@
+package bgService
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// doneToken is an mqtt.Token that has already completed.
+type doneToken struct {
+	err error
+}
+
+func (t doneToken) Wait() bool                     { return true }
+func (t doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t doneToken) Error() error                   { return t.err }
+func (t doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+type publishedMessage struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+// fakeClient is a connected mqtt.Client that records what is published.
+// Methods it doesn't implement panic through the nil embedded interface.
+type fakeClient struct {
+	mqtt.Client
+	mu        sync.Mutex
+	published []publishedMessage
+}
+
+func (c *fakeClient) IsConnected() bool      { return true }
+func (c *fakeClient) IsConnectionOpen() bool { return true }
+
+func (c *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return doneToken{}
+}
+
+func (c *fakeClient) Unsubscribe(topics ...string) mqtt.Token {
+	return doneToken{}
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var s string
+	switch v := payload.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	}
+	c.published = append(c.published, publishedMessage{topic: topic, retained: retained, payload: s})
+	return doneToken{}
+}
+
+func (c *fakeClient) messages() []publishedMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]publishedMessage(nil), c.published...)
+}
+
+// fakeMessage is a received mqtt.Message. Methods it doesn't implement panic
+// through the nil embedded interface.
+type fakeMessage struct {
+	mqtt.Message
+	topic   string
+	payload string
+}
+
+func (m fakeMessage) Topic() string   { return m.topic }
+func (m fakeMessage) Payload() []byte { return []byte(m.payload) }
+
+func TestNewCommandResponse(t *testing.T) {
+	req := scriptRequest{Command: "backup", RequestID: "abc"}
+
+	rejected := newCommandResponse(req, nil, runStatusUnknown, "Unknown command: backup")
+	if rejected.Command != "backup" || rejected.RequestID != "abc" || rejected.Status != runStatusUnknown ||
+		rejected.ExitCode != -1 || rejected.RunID != 0 || rejected.Error != "Unknown command: backup" || rejected.Host == "" {
+		t.Errorf("response to a rejected request = %+v", rejected)
+	}
+
+	started := time.Date(2026, 3, 10, 8, 0, 0, 0, time.UTC)
+	run := &ScriptRun{
+		ID:        7,
+		Status:    runStatusFailed,
+		ExitCode:  2,
+		Stdout:    "out",
+		Stderr:    "err",
+		StartedAt: started,
+		EndedAt:   started.Add(1500 * time.Millisecond),
+	}
+	response := newCommandResponse(req, run, run.Status, "exit status 2")
+	if response.RunID != 7 || response.ExitCode != 2 || response.Stdout != "out" || response.Stderr != "err" ||
+		!response.StartedAt.Equal(started) || response.DurationMs != 1500 || response.Error != "exit status 2" {
+		t.Errorf("response to a run = %+v", response)
+	}
+}
+
+func TestPublishResponse(t *testing.T) {
+	const topic = "winsense/home/office/response"
+	tests := []struct {
+		name     string
+		response commandResponse
+		legacy   bool
+		// payload is the plain text published in legacy mode
+		payload string
+	}{
+		{name: "JSON", response: commandResponse{Command: "backup", Status: runStatusSuccess, Stdout: "done"}},
+		{name: "legacy output", response: commandResponse{Command: "backup", Status: runStatusSuccess, Stdout: "done"}, legacy: true, payload: "done"},
+		{name: "legacy error", response: commandResponse{Command: "backup", Status: runStatusFailed, Stdout: "partial", Error: "exit status 1"}, legacy: true, payload: "exit status 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeClient{}
+			p := &program{Logger: discardLogger{}}
+			p.config.Topic = "home"
+			p.config.ClientID = "office"
+			p.publishResponse(client, tt.response, tt.legacy)
+
+			messages := client.messages()
+			if len(messages) != 1 || messages[0].topic != topic || messages[0].retained {
+				t.Fatalf("published %+v, want one message on %s", messages, topic)
+			}
+			if tt.legacy {
+				if messages[0].payload != tt.payload {
+					t.Errorf("payload = %q, want %q", messages[0].payload, tt.payload)
+				}
+				return
+			}
+			var response commandResponse
+			if err := json.Unmarshal([]byte(messages[0].payload), &response); err != nil {
+				t.Fatalf("payload isn't JSON: %v", err)
+			}
+			if response.Command != tt.response.Command || response.Status != tt.response.Status || response.Stdout != tt.response.Stdout {
+				t.Errorf("response = %+v, want %+v", response, tt.response)
+			}
+		})
+	}
+}
+
+func TestAvailabilityTopicAndPayloads(t *testing.T) {
+	tests := []struct {
+		name                    string
+		statusTopic             string
+		online, offline         string
+		wantTopic               string
+		wantOnline, wantOffline string
+	}{
+		{
+			name:        "defaults",
+			wantTopic:   "winsense/home/office/status",
+			wantOnline:  "online",
+			wantOffline: "offline",
+		},
+		{
+			name:        "configured",
+			statusTopic: "pcs/office/availability",
+			online:      "up",
+			offline:     "down",
+			wantTopic:   "pcs/office/availability",
+			wantOnline:  "up",
+			wantOffline: "down",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &program{}
+			p.config.Topic = "home"
+			p.config.ClientID = "office"
+			p.config.StatusTopic = tt.statusTopic
+			p.config.PayloadOnline = tt.online
+			p.config.PayloadOffline = tt.offline
+
+			if topic := p.statusTopic(); topic != tt.wantTopic {
+				t.Errorf("status topic = %q, want %q", topic, tt.wantTopic)
+			}
+			if online := p.payloadOnline(); online != tt.wantOnline {
+				t.Errorf("online payload = %q, want %q", online, tt.wantOnline)
+			}
+			if offline := p.payloadOffline(); offline != tt.wantOffline {
+				t.Errorf("offline payload = %q, want %q", offline, tt.wantOffline)
+			}
+		})
+	}
+}
+
+func TestPublishAvailabilityIsRetained(t *testing.T) {
+	client := &fakeClient{}
+	p := &program{Logger: discardLogger{}}
+	p.config.Topic = "home"
+	p.config.ClientID = "office"
+
+	p.publishAvailability(client, p.payloadOnline())
+	messages := client.messages()
+	want := publishedMessage{topic: "winsense/home/office/status", retained: true, payload: "online"}
+	if len(messages) != 1 || messages[0] != want {
+		t.Errorf("published %+v, want %+v", messages, want)
+	}
+}
+
+func TestLastWill(t *testing.T) {
+	p := &program{Logger: discardLogger{}}
+	p.config.BrokerAddress = "tcp://localhost:1883"
+	p.config.Topic = "home"
+	p.config.ClientID = "office"
+	p.config.PayloadOffline = "gone"
+
+	if err := p.setupMQTTClient(); err != nil {
+		t.Fatal(err)
+	}
+	options := p.mqttClient.OptionsReader()
+	if !options.WillEnabled() || options.WillTopic() != "winsense/home/office/status" ||
+		string(options.WillPayload()) != "gone" || !options.WillRetained() || options.WillQos() != 1 {
+		t.Errorf("will = enabled %v, topic %q, payload %q, retained %v, qos %d, want the retained offline payload on the status topic",
+			options.WillEnabled(), options.WillTopic(), options.WillPayload(), options.WillRetained(), options.WillQos())
+	}
+}
@@ -0,0 +1,165 @@
+package bgService
+
+import (
+	"fmt"
+	"reflect"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// reloadConfig re-reads the config from the database and applies it to the
+// running service. The MQTT client is only rebuilt when a connection setting
+// changed, subscriptions are only redone when the topics changed, and the HTTP
+// server is only restarted when its address, certificate or CORS origins
+// changed.
+func (p *program) reloadConfig() error {
+	p.reloadMutex.Lock()
+	defer p.reloadMutex.Unlock()
+
+	p.Logger.Debug("Reloading config")
+	newConfig, err := p.db.GetConfig()
+	if err != nil {
+		return fmt.Errorf("failed to get config: %v", err)
+	}
+
+	oldConfig := p.currentConfig()
+	config := *newConfig
+	client := p.currentMQTTClient()
+	reconnect := client != nil && connectionChanged(oldConfig, config)
+	if reconnect {
+		// Clean up and disconnect while p.config still points at the old
+		// status and discovery topics
+		p.Logger.Debug("MQTT connection settings changed, reconnecting")
+		if discoveryID(oldConfig.ClientID) != discoveryID(config.ClientID) {
+			p.clearDiscovery(client)
+		}
+		if statusTopic(oldConfig) != statusTopic(config) {
+			p.clearAvailability(client)
+		} else {
+			p.disconnectMQTT(client)
+		}
+	}
+
+	p.setConfig(config)
+
+	if httpChanged(oldConfig, config) {
+		p.Logger.Debug(fmt.Sprintf("HTTP settings changed, restarting the HTTP server on %s", config.DashboardURL()))
+		// Restart in the background, this may run in a request that the
+		// shutdown waits for
+		go p.restartHTTPServer()
+	}
+
+	if p.sensors != nil {
+		if err := p.loadSensors(); err != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to reload sensors: %v", err))
+		}
+	}
+
+	if client == nil {
+		// run() hasn't set up the client yet and will pick up the new config
+		return nil
+	}
+
+	if reconnect {
+		if err := p.setupMQTTClient(); err != nil {
+			return fmt.Errorf("failed to set up MQTT client: %v", err)
+		}
+		go p.connectMQTT(p.currentMQTTClient())
+		return nil
+	}
+
+	if !client.IsConnectionOpen() {
+		// onConnect will subscribe and publish discovery with the new config
+		return nil
+	}
+
+	if oldConfig.Topic != config.Topic {
+		p.Logger.Debug("MQTT topics changed, re-subscribing")
+		if token := client.Unsubscribe(commandTopic(oldConfig), responseTopic(oldConfig)); token.Wait() && token.Error() != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to unsubscribe from old topics: %v", token.Error()))
+		}
+		p.onConnect(client)
+	} else if !reflect.DeepEqual(commandNames(oldConfig), commandNames(config)) {
+		p.publishDiscovery(client)
+	}
+
+	for command := range oldConfig.Commands {
+		if _, exists := config.Commands[command]; !exists {
+			p.removeDiscovery(client, command)
+		}
+	}
+
+	p.Logger.Info("Config reloaded")
+	return nil
+}
+
+// connectionChanged reports whether the MQTT client has to be rebuilt to apply
+// the new config. The status topic and payloads are part of this because the
+// Last Will is only sent to the broker when connecting. The status topic is
+// compared as resolved, since by default it follows the base topic.
+func connectionChanged(oldConfig, newConfig Config) bool {
+	return oldConfig.BrokerAddress != newConfig.BrokerAddress ||
+		oldConfig.Username != newConfig.Username ||
+		oldConfig.Password != newConfig.Password ||
+		oldConfig.ClientID != newConfig.ClientID ||
+		statusTopic(oldConfig) != statusTopic(newConfig) ||
+		oldConfig.PayloadOnline != newConfig.PayloadOnline ||
+		oldConfig.PayloadOffline != newConfig.PayloadOffline ||
+		oldConfig.TLSCAFile != newConfig.TLSCAFile ||
+		oldConfig.TLSCertFile != newConfig.TLSCertFile ||
+		oldConfig.TLSKeyFile != newConfig.TLSKeyFile ||
+		oldConfig.TLSServerName != newConfig.TLSServerName ||
+		oldConfig.TLSInsecure != newConfig.TLSInsecure
+}
+
+// httpChanged reports whether the HTTP server has to be restarted to apply the
+// new config.
+func httpChanged(oldConfig, newConfig Config) bool {
+	return oldConfig.HTTPAddress() != newConfig.HTTPAddress() ||
+		oldConfig.HTTPTLSCertFile != newConfig.HTTPTLSCertFile ||
+		oldConfig.HTTPTLSKeyFile != newConfig.HTTPTLSKeyFile ||
+		oldConfig.HTTPSelfSigned != newConfig.HTTPSelfSigned ||
+		oldConfig.CORSAllowedOrigins != newConfig.CORSAllowedOrigins
+}
+
+func commandNames(config Config) map[string]string {
+	names := make(map[string]string)
+	for name, scriptConfig := range config.Commands {
+		names[name] = scriptConfig.ScriptPath
+	}
+	return names
+}
+
+func (p *program) connectMQTT(client mqtt.Client) {
+	p.Logger.Debug(fmt.Sprintf("Attempting to connect to MQTT broker at %s...", p.currentConfig().BrokerAddress))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		p.Logger.Error(fmt.Sprintf("Connection failed: %v", token.Error()))
+		p.mqttState.failed(token.Error())
+	} else {
+		p.Logger.Debug("Connection successful")
+	}
+}
+
+// disconnectMQTT publishes the offline payload and disconnects. A clean
+// disconnect doesn't trigger the Last Will, so we publish it ourselves.
+func (p *program) disconnectMQTT(client mqtt.Client) {
+	if client.IsConnectionOpen() {
+		p.publishAvailability(client, p.payloadOffline())
+	}
+	// Also aborts a connection attempt that is still being retried
+	client.Disconnect(250)
+}
+
+// clearAvailability removes the retained availability from the status topic
+// and disconnects, for when the service moves to another status topic. Nothing
+// would ever update the old one again.
+func (p *program) clearAvailability(client mqtt.Client) {
+	if client.IsConnectionOpen() {
+		if token := client.Publish(p.statusTopic(), 1, true, ""); token.Wait() && token.Error() != nil {
+			p.Logger.Error(fmt.Sprintf("Failed to clear availability on %s: %v", p.statusTopic(), token.Error()))
+		} else {
+			p.Logger.Debug(fmt.Sprintf("Cleared availability on %s", p.statusTopic()))
+		}
+	}
+	client.Disconnect(250)
+}
@@ -0,0 +1,121 @@
+package bgService
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"win-sense-connect/internal/shared"
+)
+
+// newTestDB returns a migrated database in a temporary directory.
+func newTestDB(t *testing.T) *shared.DB {
+	t.Helper()
+	sqlDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "store.db")+"?_txlock=immediate&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	db := &shared.DB{DB: sqlDB}
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newTestProgram returns a program with a database holding config and a
+// connected fake MQTT client, the way run leaves it.
+func newTestProgram(t *testing.T, config Config) (*program, *fakeClient) {
+	t.Helper()
+	dir := t.TempDir()
+	p := &program{db: newTestDB(t), scriptDir: dir}
+	p.Logger = &Logger{file: newLogFile(filepath.Join(dir, "service.log")), config: p.currentConfig, elog: &recordingSystemLog{}}
+	t.Cleanup(p.Logger.Close)
+	p.executor = newScriptExecutor(func() int { return p.currentConfig().MaxConcurrent })
+	p.metrics = newServiceMetrics(p)
+
+	if err := p.db.SaveConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.loadConfig(p.Logger); err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeClient{}
+	p.setMQTTClient(client)
+	return p, client
+}
+
+// TestReloadWhileHandlingCommands reloads the config back and forth while
+// commands are handled and the status is read, so the race detector sees every
+// reader of the config and the MQTT client.
+func TestReloadWhileHandlingCommands(t *testing.T) {
+	// A fixed status topic keeps topic changes from rebuilding the client
+	p, client := newTestProgram(t, Config{BrokerAddress: "tcp://localhost:1883", ClientID: "office", Topic: "home", StatusTopic: "pcs/office", LogLevel: "debug"})
+	if err := os.WriteFile(filepath.Join(p.scriptDir, "wait.sh"), []byte("echo done\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.db.CreateScriptConfig(&ScriptConfig{Name: "wait", ScriptPath: "wait.sh", Concurrency: concurrencyParallel}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	const senders, commands, reloads = 4, 10, 20
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < commands; j++ {
+				p.commandHandler(client, fakeMessage{topic: commandTopic(p.currentConfig()), payload: "wait"})
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < reloads; i++ {
+			config := p.currentConfig()
+			config.Topic = []string{"home", "office"}[i%2]
+			config.LegacyResponses = i%2 == 0
+			config.LogFormat = []string{logFormatText, logFormatJSON}[i%2]
+			if err := p.db.UpdateConfig(&config); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := p.reloadConfig(); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := p.reloadSensors(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < reloads; i++ {
+			p.mqttStatus()
+			if _, err := p.metrics.registry.Gather(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	responses := 0
+	for _, message := range client.messages() {
+		if strings.HasSuffix(message.topic, "/response") {
+			responses++
+		}
+	}
+	if responses != senders*commands {
+		t.Errorf("published %d responses, want one for each of the %d commands", responses, senders*commands)
+	}
+}
@@ -0,0 +1,360 @@
+package bgService
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Comparison operators a sensor rule can use
+const (
+	ruleAbove        = ">"
+	ruleAboveOrEqual = ">="
+	ruleBelow        = "<"
+	ruleBelowOrEqual = "<="
+)
+
+// States published on a rule's alert topic
+const (
+	ruleStateTriggered = "triggered"
+	ruleStateResolved  = "resolved"
+)
+
+// defaultRuleInterval is how often a rule samples its sensor when it doesn't
+// set an interval.
+const defaultRuleInterval = 10
+
+var errInvalidRule = errors.New("invalid sensor rule")
+
+// numericSensors are the sensors that return a single number a rule can
+// compare against its threshold.
+var numericSensors = map[string]bool{
+	"cpu_usage":       true,
+	"cpu_temperature": true,
+	"memory_usage":    true,
+	"disk_usage":      true,
+	"uptime":          true,
+}
+
+// sensorValue reads a numeric sensor.
+func sensorValue(name string) (float64, error) {
+	if !numericSensors[name] {
+		return 0, fmt.Errorf("sensor '%s' is not numeric", name)
+	}
+	value, err := sensorCollectors[name]()
+	if err != nil {
+		return 0, err
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case uint64:
+		return float64(v), nil
+	}
+	return 0, fmt.Errorf("sensor '%s' returned %T", name, value)
+}
+
+func checkSensorRule(rule SensorRule) error {
+	if strings.TrimSpace(rule.Name) == "" {
+		return fmt.Errorf("%w: name is required", errInvalidRule)
+	}
+	if !numericSensors[rule.Sensor] {
+		return fmt.Errorf("%w: sensor '%s' can't be used in a rule", errInvalidRule, rule.Sensor)
+	}
+	switch rule.Operator {
+	case ruleAbove, ruleAboveOrEqual, ruleBelow, ruleBelowOrEqual:
+	default:
+		return fmt.Errorf("%w: unknown operator '%s'", errInvalidRule, rule.Operator)
+	}
+	if rule.Duration < 0 || rule.Interval < 0 || rule.Hysteresis < 0 {
+		return fmt.Errorf("%w: duration, interval and hysteresis can't be negative", errInvalidRule)
+	}
+	if rule.ScriptID == 0 && rule.AlertTopic == "" {
+		return fmt.Errorf("%w: a script_id or alert_topic is required", errInvalidRule)
+	}
+	return nil
+}
+
+// ruleState tracks a rule between samples. A rule triggers once its condition
+// held for Duration seconds, and resolves once the value is back past the
+// threshold by more than Hysteresis, so a value hovering around the threshold
+// doesn't make it flap.
+type ruleState struct {
+	pendingSince time.Time
+	triggered    bool
+}
+
+// evaluate feeds a sample into the state and reports whether the rule just
+// triggered or resolved.
+func (s *ruleState) evaluate(rule SensorRule, value float64, now time.Time) (triggered, resolved bool) {
+	if s.triggered {
+		if ruleCleared(rule, value) {
+			s.triggered = false
+			s.pendingSince = time.Time{}
+			return false, true
+		}
+		return false, false
+	}
+
+	if !ruleMatches(rule, value) {
+		s.pendingSince = time.Time{}
+		return false, false
+	}
+	if s.pendingSince.IsZero() {
+		s.pendingSince = now
+	}
+	if now.Sub(s.pendingSince) >= time.Duration(rule.Duration)*time.Second {
+		s.triggered = true
+		return true, false
+	}
+	return false, false
+}
+
+func ruleMatches(rule SensorRule, value float64) bool {
+	switch rule.Operator {
+	case ruleAbove:
+		return value > rule.Threshold
+	case ruleAboveOrEqual:
+		return value >= rule.Threshold
+	case ruleBelow:
+		return value < rule.Threshold
+	case ruleBelowOrEqual:
+		return value <= rule.Threshold
+	}
+	return false
+}
+
+func ruleCleared(rule SensorRule, value float64) bool {
+	switch rule.Operator {
+	case ruleAbove, ruleAboveOrEqual:
+		return value < rule.Threshold-rule.Hysteresis
+	case ruleBelow, ruleBelowOrEqual:
+		return value > rule.Threshold+rule.Hysteresis
+	}
+	return true
+}
+
+// ruleAlert is the JSON document published on a rule's alert topic.
+type ruleAlert struct {
+	Rule      string    `json:"rule"`
+	Sensor    string    `json:"sensor"`
+	State     string    `json:"state"`
+	Value     float64   `json:"value"`
+	Operator  string    `json:"operator"`
+	Threshold float64   `json:"threshold"`
+	Timestamp time.Time `json:"timestamp"`
+	Host      string    `json:"host"`
+}
+
+// ruleEngine runs one sampling goroutine per enabled sensor rule.
+type ruleEngine struct {
+	p       *program
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	running map[int64]*ruleRunner
+}
+
+type ruleRunner struct {
+	rule SensorRule
+	stop chan struct{}
+}
+
+func newRuleEngine(p *program) *ruleEngine {
+	return &ruleEngine{
+		p:       p,
+		running: make(map[int64]*ruleRunner),
+	}
+}
+
+// Sync starts rules that became enabled, stops the ones that were disabled or
+// removed and restarts the ones that changed.
+func (e *ruleEngine) Sync(rules SensorRules) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	wanted := make(map[int64]SensorRule)
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		if err := checkSensorRule(rule); err != nil {
+			e.p.Logger.Error(fmt.Sprintf("Sensor rule '%s' is invalid, skipping: %v", rule.Name, err))
+			continue
+		}
+		wanted[rule.ID] = rule
+	}
+
+	for id, runner := range e.running {
+		rule, keep := wanted[id]
+		if keep && rule.UpdatedAt.Equal(runner.rule.UpdatedAt) {
+			continue
+		}
+		e.p.Logger.Debug(fmt.Sprintf("Stopping sensor rule '%s'", runner.rule.Name))
+		close(runner.stop)
+		delete(e.running, id)
+	}
+
+	for id, rule := range wanted {
+		if _, exists := e.running[id]; exists {
+			continue
+		}
+		runner := &ruleRunner{
+			rule: rule,
+			stop: make(chan struct{}),
+		}
+		e.running[id] = runner
+		e.wg.Add(1)
+		go e.run(runner)
+	}
+}
+
+// Stop stops every rule and waits for them to exit.
+func (e *ruleEngine) Stop() {
+	e.mu.Lock()
+	for id, runner := range e.running {
+		close(runner.stop)
+		delete(e.running, id)
+	}
+	e.mu.Unlock()
+	e.wg.Wait()
+}
+
+// Active returns how many sensor rules are running.
+func (e *ruleEngine) Active() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.running)
+}
+
+func (e *ruleEngine) run(runner *ruleRunner) {
+	defer e.wg.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			e.p.Logger.Error(fmt.Sprintf("Recovered from panic in sensor rule '%s': %v\nStack trace: %s", runner.rule.Name, r, debug.Stack()))
+		}
+	}()
+
+	rule := runner.rule
+	interval := rule.Interval
+	if interval <= 0 {
+		interval = defaultRuleInterval
+	}
+	e.p.Logger.Debug(fmt.Sprintf("Starting sensor rule '%s' every %d seconds", rule.Name, interval))
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	var state ruleState
+	for {
+		value, err := sensorValue(rule.Sensor)
+		if err != nil {
+			e.p.Logger.Error(fmt.Sprintf("Sensor rule '%s' failed to read sensor '%s': %v", rule.Name, rule.Sensor, err))
+		} else {
+			triggered, resolved := state.evaluate(rule, value, time.Now())
+			if triggered {
+				e.p.Logger.Info("Sensor rule triggered", "rule", rule.Name, "sensor", rule.Sensor, "value", value)
+				e.p.publishRuleAlert(rule, ruleStateTriggered, value)
+				e.p.runRuleScript(rule)
+			} else if resolved {
+				e.p.Logger.Info("Sensor rule resolved", "rule", rule.Name, "sensor", rule.Sensor, "value", value)
+				e.p.publishRuleAlert(rule, ruleStateResolved, value)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-runner.stop:
+			return
+		}
+	}
+}
+
+func (p *program) publishRuleAlert(rule SensorRule, state string, value float64) {
+	if rule.AlertTopic == "" {
+		return
+	}
+	client := p.currentMQTTClient()
+	if client == nil || !client.IsConnected() {
+		p.Logger.Debug(fmt.Sprintf("MQTT client not connected, skipping alert of sensor rule '%s'", rule.Name))
+		return
+	}
+
+	host, _ := os.Hostname()
+	payload, err := json.Marshal(ruleAlert{
+		Rule:      rule.Name,
+		Sensor:    rule.Sensor,
+		State:     state,
+		Value:     value,
+		Operator:  rule.Operator,
+		Threshold: rule.Threshold,
+		Timestamp: time.Now().UTC(),
+		Host:      host,
+	})
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to marshal alert of sensor rule '%s': %v", rule.Name, err))
+		return
+	}
+
+	if token := client.Publish(rule.AlertTopic, 1, false, payload); token.Wait() && token.Error() != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to publish alert of sensor rule '%s': %v", rule.Name, token.Error()))
+	}
+}
+
+// runRuleScript starts the rule's script without waiting for it, so the rule
+// keeps sampling while the script runs.
+func (p *program) runRuleScript(rule SensorRule) {
+	if rule.ScriptID == 0 {
+		return
+	}
+
+	command, ok := p.scriptCommandName(rule.ScriptID)
+	if !ok {
+		p.Logger.Error(fmt.Sprintf("Sensor rule '%s' refers to script %d, which doesn't exist", rule.Name, rule.ScriptID))
+		return
+	}
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				p.Logger.Error(fmt.Sprintf("Recovered from panic in sensor rule '%s': %v\nStack trace: %s", rule.Name, r, debug.Stack()))
+			}
+		}()
+
+		run, err := p.runScript(scriptRequest{
+			Command:   command,
+			RequestID: fmt.Sprintf("rule-%d", rule.ID),
+			Source:    runSourceRule,
+		})
+		if err != nil {
+			p.Logger.Error(fmt.Sprintf("Command '%s' of sensor rule '%s' failed: %v", command, rule.Name, err))
+			return
+		}
+		p.Logger.Debug(fmt.Sprintf("Command '%s' of sensor rule '%s' finished with status %s", command, rule.Name, run.Status))
+	}()
+}
+
+// reloadRules re-reads the sensor_rules table and applies it to the running
+// engine.
+func (p *program) reloadRules() error {
+	p.reloadMutex.Lock()
+	defer p.reloadMutex.Unlock()
+	return p.loadRules()
+}
+
+// loadRules is reloadRules for callers that hold reloadMutex.
+func (p *program) loadRules() error {
+	rules, err := p.db.GetSensorRules()
+	if err != nil {
+		return fmt.Errorf("failed to get sensor rules: %v", err)
+	}
+
+	if p.rules != nil {
+		p.rules.Sync(*rules)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package bgService
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRuleStateEvaluate(t *testing.T) {
+	type sample struct {
+		// at is the number of seconds since the first sample
+		at        int
+		value     float64
+		triggered bool
+		resolved  bool
+	}
+	tests := []struct {
+		name    string
+		rule    SensorRule
+		samples []sample
+	}{
+		{
+			name: "triggers at once without a duration",
+			rule: SensorRule{Operator: ruleAbove, Threshold: 80},
+			samples: []sample{
+				{at: 0, value: 80},
+				{at: 10, value: 81, triggered: true},
+				{at: 20, value: 90},
+				{at: 30, value: 79, resolved: true},
+			},
+		},
+		{
+			name: "or equal includes the threshold",
+			rule: SensorRule{Operator: ruleAboveOrEqual, Threshold: 80},
+			samples: []sample{
+				{at: 0, value: 80, triggered: true},
+				{at: 10, value: 80},
+				{at: 20, value: 79.9, resolved: true},
+			},
+		},
+		{
+			name: "waits for the duration",
+			rule: SensorRule{Operator: ruleAbove, Threshold: 80, Duration: 30},
+			samples: []sample{
+				{at: 0, value: 90},
+				{at: 10, value: 90},
+				{at: 29, value: 90},
+				{at: 30, value: 90, triggered: true},
+				{at: 40, value: 90},
+			},
+		},
+		{
+			name: "a dip restarts the duration",
+			rule: SensorRule{Operator: ruleAbove, Threshold: 80, Duration: 30},
+			samples: []sample{
+				{at: 0, value: 90},
+				{at: 20, value: 70},
+				{at: 30, value: 90},
+				{at: 50, value: 90},
+				{at: 60, value: 90, triggered: true},
+			},
+		},
+		{
+			name: "hysteresis delays resolving above",
+			rule: SensorRule{Operator: ruleAbove, Threshold: 80, Hysteresis: 5},
+			samples: []sample{
+				{at: 0, value: 85, triggered: true},
+				{at: 10, value: 79},
+				{at: 20, value: 75},
+				{at: 30, value: 74.9, resolved: true},
+				{at: 40, value: 79},
+				{at: 50, value: 81, triggered: true},
+			},
+		},
+		{
+			name: "hysteresis delays resolving below",
+			rule: SensorRule{Operator: ruleBelow, Threshold: 10, Hysteresis: 2},
+			samples: []sample{
+				{at: 0, value: 11},
+				{at: 10, value: 9, triggered: true},
+				{at: 20, value: 12},
+				{at: 30, value: 12.5, resolved: true},
+			},
+		},
+		{
+			name: "below or equal",
+			rule: SensorRule{Operator: ruleBelowOrEqual, Threshold: 10},
+			samples: []sample{
+				{at: 0, value: 10, triggered: true},
+				{at: 10, value: 10.1, resolved: true},
+			},
+		},
+	}
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var state ruleState
+			for _, s := range tt.samples {
+				triggered, resolved := state.evaluate(tt.rule, s.value, start.Add(time.Duration(s.at)*time.Second))
+				if triggered != s.triggered || resolved != s.resolved {
+					t.Errorf("at %ds value %v: triggered, resolved = %v, %v, want %v, %v",
+						s.at, s.value, triggered, resolved, s.triggered, s.resolved)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package bgService
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"win-sense-connect/internal/common"
+)
+
+// Sources a script run can be triggered from
+const (
+	runSourceMQTT     = "mqtt"
+	runSourceHTTP     = "http"
+	runSourceHotkey   = common.RunSourceHotkey
+	runSourceSchedule = "schedule"
+	runSourceRule     = "rule"
+)
+
+// Outcomes recorded for a script run
+const (
+	runStatusQueued    = "queued"
+	runStatusRunning   = common.RunStatusRunning
+	runStatusSuccess   = common.RunStatusSuccess
+	runStatusFailed    = common.RunStatusFailed
+	runStatusTimeout   = "timeout"
+	runStatusCancelled = "cancelled"
+	runStatusRejected  = "rejected"
+	runStatusInvalid   = "invalid"
+	runStatusUnknown   = "unknown"
+)
+
+var (
+	errUnknownCommand = errors.New("unknown command")
+	errInvalidRequest = errors.New("invalid command request")
+	errRunNotFound    = errors.New("no matching run is queued or running")
+)
+
+// cancelCommand is the reserved command name that cancels runs instead of
+// running a script.
+const cancelCommand = "cancel"
+
+// scriptRequest is a single request to run a command. Over MQTT it is either a
+// plain command name or a JSON envelope of this shape.
+type scriptRequest struct {
+	Command   string                 `json:"command"`
+	Args      map[string]interface{} `json:"args,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Source    string                 `json:"-"`
+}
+
+// runScript executes the script registered for the requested command and
+// records the run in the script_runs history. The run waits in the executor
+// until the command's concurrency policy and the global limit allow it to
+// start. The returned run is never nil unless the request is invalid or the
+// command is unknown.
+func (p *program) runScript(req scriptRequest) (*ScriptRun, error) {
+	command := req.Command
+	scriptConfig, exists := p.currentConfig().Commands[command]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", errUnknownCommand, command)
+	}
+
+	args, err := newScriptArgs(req)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &ScriptRun{
+		Command:   command,
+		Source:    req.Source,
+		RequestID: req.RequestID,
+		Status:    runStatusQueued,
+		StartedAt: time.Now().UTC(),
+	}
+	if err := p.db.CreateScriptRun(run); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to record script run for command '%s': %v", command, err))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	untrack := p.executor.track(run, cancel)
+	defer untrack()
+
+	release, err := p.executor.acquire(ctx, command, scriptConfig.Concurrency, cancel)
+	if err != nil {
+		run.EndedAt = time.Now().UTC()
+		run.ExitCode = -1
+		run.Status = runStatusCancelled
+		if errors.Is(err, errCommandBusy) {
+			run.Status = runStatusRejected
+		}
+		p.updateScriptRun(run)
+		p.metrics.scriptRunFinished(run)
+		return run, err
+	}
+	defer release()
+
+	run.Status = runStatusRunning
+	run.StartedAt = time.Now().UTC()
+	p.updateScriptRun(run)
+
+	scriptPath := filepath.Join(p.scriptDir, scriptConfig.ScriptPath)
+	p.Logger.Debug(fmt.Sprintf("Executing script: %s", scriptPath))
+
+	timeout := p.scriptTimeout(scriptConfig)
+	result, err := p.executeScript(ctx, scriptPath, scriptConfig, timeout, args)
+
+	run.EndedAt = time.Now().UTC()
+	run.ExitCode = result.ExitCode
+	run.Stdout = common.TruncateRunOutput(result.Stdout)
+	run.Stderr = common.TruncateRunOutput(result.Stderr)
+	switch {
+	case errors.Is(err, errScriptTimeout):
+		run.Status = runStatusTimeout
+	case errors.Is(err, errRunCancelled):
+		run.Status = runStatusCancelled
+	case err != nil:
+		run.Status = runStatusFailed
+	default:
+		run.Status = runStatusSuccess
+	}
+
+	p.updateScriptRun(run)
+	p.metrics.scriptRunFinished(run)
+	p.Logger.Info("Command finished", "command", command, "run_id", run.ID, "source", run.Source,
+		"status", run.Status, "exit_code", run.ExitCode, "duration", run.EndedAt.Sub(run.StartedAt).Round(time.Millisecond))
+
+	return run, err
+}
+
+// cancelScriptRuns cancels the queued or running runs selected by the args of a
+// cancel request: "run_id", "request_id" or "command". The cancelled runs kill
+// their process tree and finish with status cancelled.
+func (p *program) cancelScriptRuns(req scriptRequest) (int, error) {
+	var runID int64
+	var requestID, command string
+	for name, value := range req.Args {
+		switch name {
+		case "run_id":
+			id, ok := value.(float64)
+			if !ok || id <= 0 || id != float64(int64(id)) {
+				return 0, fmt.Errorf("%w: run_id must be a positive integer", errInvalidRequest)
+			}
+			runID = int64(id)
+		case "request_id", "command":
+			str, ok := value.(string)
+			if !ok || str == "" {
+				return 0, fmt.Errorf("%w: %s must be a non-empty string", errInvalidRequest, name)
+			}
+			if name == "command" {
+				command = str
+			} else {
+				requestID = str
+			}
+		default:
+			return 0, fmt.Errorf("%w: unknown cancel argument '%s'", errInvalidRequest, name)
+		}
+	}
+	if runID == 0 && requestID == "" && command == "" {
+		return 0, fmt.Errorf("%w: cancel needs a run_id, request_id or command", errInvalidRequest)
+	}
+
+	cancelled := p.executor.cancelRuns(func(run *ScriptRun) bool {
+		return (runID == 0 || run.ID == runID) &&
+			(requestID == "" || run.RequestID == requestID) &&
+			(command == "" || run.Command == command)
+	})
+	if cancelled == 0 {
+		return 0, errRunNotFound
+	}
+	p.Logger.Debug(fmt.Sprintf("Cancelled %d script run(s)", cancelled))
+	return cancelled, nil
+}
+
+func (p *program) updateScriptRun(run *ScriptRun) {
+	if run.ID == 0 {
+		return
+	}
+	if err := p.db.UpdateScriptRun(run); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to update script run %d: %v", run.ID, err))
+	}
+}
+
+// parseCommandPayload accepts either a plain command name or a JSON envelope
+// like {"command": "set_volume", "args": {"level": 30}, "request_id": "abc"}.
+// The returned bool reports whether the payload was an envelope.
+func parseCommandPayload(payload []byte) (scriptRequest, bool, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return scriptRequest{Command: string(payload)}, false, nil
+	}
+
+	var req scriptRequest
+	if err := json.Unmarshal(trimmed, &req); err != nil {
+		return scriptRequest{}, true, fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+	if req.Command == "" {
+		return req, true, fmt.Errorf("%w: missing command", errInvalidRequest)
+	}
+	return req, true, nil
+}
+
+var scriptArgName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// scriptArgs holds request arguments in the two forms they are handed to a
+// script: named PowerShell parameters and WINSENSE_* environment variables.
+type scriptArgs struct {
+	names  []string
+	values map[string]string
+	env    []string
+}
+
+func newScriptArgs(req scriptRequest) (scriptArgs, error) {
+	args := scriptArgs{
+		values: make(map[string]string),
+	}
+
+	for name, value := range req.Args {
+		if !scriptArgName.MatchString(name) {
+			return scriptArgs{}, fmt.Errorf("%w: invalid argument name '%s'", errInvalidRequest, name)
+		}
+
+		var str string
+		switch v := value.(type) {
+		case string:
+			str = v
+		case nil:
+			str = ""
+		case float64:
+			// Not fmt.Sprint, which writes large numbers like 1e+06
+			str = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			str = strconv.FormatBool(v)
+		default:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				return scriptArgs{}, fmt.Errorf("%w: invalid value for argument '%s'", errInvalidRequest, name)
+			}
+			str = string(encoded)
+		}
+
+		args.names = append(args.names, name)
+		args.values[name] = str
+		args.env = append(args.env, "WINSENSE_ARG_"+strings.ToUpper(name)+"="+str)
+	}
+	sort.Strings(args.names)
+
+	if req.RequestID != "" {
+		args.env = append(args.env, "WINSENSE_REQUEST_ID="+req.RequestID)
+	}
+	return args, nil
+}
+
+// Environ returns env extended with the request arguments.
+func (a scriptArgs) Environ(env []string) []string {
+	return append(env, a.env...)
+}
+
+// Params returns the arguments as "-name value" pairs for powershell -File.
+func (a scriptArgs) Params() []string {
+	var params []string
+	for _, name := range a.names {
+		params = append(params, "-"+name, a.values[name])
+	}
+	return params
+}
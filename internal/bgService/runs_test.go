@@ -0,0 +1,141 @@
+package bgService
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseCommandPayload(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		req      scriptRequest
+		envelope bool
+		err      bool
+	}{
+		{name: "plain command", payload: "shutdown", req: scriptRequest{Command: "shutdown"}},
+		{name: "empty", payload: "", req: scriptRequest{Command: ""}},
+		{
+			name:     "envelope",
+			payload:  `{"command": "set_volume", "args": {"level": 30}, "request_id": "abc"}`,
+			req:      scriptRequest{Command: "set_volume", Args: map[string]interface{}{"level": float64(30)}, RequestID: "abc"},
+			envelope: true,
+		},
+		{
+			name:     "envelope with surrounding whitespace",
+			payload:  " \n{\"command\": \"lock\"}\n",
+			req:      scriptRequest{Command: "lock"},
+			envelope: true,
+		},
+		{name: "invalid JSON", payload: `{"command": `, envelope: true, err: true},
+		{name: "missing command", payload: `{"args": {"level": 30}}`, envelope: true, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, envelope, err := parseCommandPayload([]byte(tt.payload))
+			if envelope != tt.envelope {
+				t.Errorf("envelope = %v, want %v", envelope, tt.envelope)
+			}
+			if tt.err {
+				if !errors.Is(err, errInvalidRequest) {
+					t.Errorf("err = %v, want %v", err, errInvalidRequest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(req, tt.req) {
+				t.Errorf("request = %+v, want %+v", req, tt.req)
+			}
+		})
+	}
+}
+
+func TestNewScriptArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    scriptRequest
+		values map[string]string
+		env    []string
+		err    bool
+	}{
+		{
+			name:   "no arguments",
+			req:    scriptRequest{Command: "lock"},
+			values: map[string]string{},
+		},
+		{
+			name: "scalar values",
+			req: scriptRequest{Args: map[string]interface{}{
+				"level":   float64(30),
+				"big":     float64(1000000),
+				"ratio":   0.25,
+				"enabled": true,
+				"target":  "tv",
+				"empty":   nil,
+			}},
+			values: map[string]string{
+				"level":   "30",
+				"big":     "1000000",
+				"ratio":   "0.25",
+				"enabled": "true",
+				"target":  "tv",
+				"empty":   "",
+			},
+			env: []string{
+				"WINSENSE_ARG_BIG=1000000",
+				"WINSENSE_ARG_EMPTY=",
+				"WINSENSE_ARG_ENABLED=true",
+				"WINSENSE_ARG_LEVEL=30",
+				"WINSENSE_ARG_RATIO=0.25",
+				"WINSENSE_ARG_TARGET=tv",
+			},
+		},
+		{
+			name: "nested values are passed as JSON",
+			req: scriptRequest{Args: map[string]interface{}{
+				"list": []interface{}{float64(1), "two"},
+				"map":  map[string]interface{}{"a": true},
+			}},
+			values: map[string]string{"list": `[1,"two"]`, "map": `{"a":true}`},
+			env:    []string{`WINSENSE_ARG_LIST=[1,"two"]`, `WINSENSE_ARG_MAP={"a":true}`},
+		},
+		{
+			name:   "request id",
+			req:    scriptRequest{RequestID: "abc", Args: map[string]interface{}{"x": "1"}},
+			values: map[string]string{"x": "1"},
+			env:    []string{"WINSENSE_ARG_X=1", "WINSENSE_REQUEST_ID=abc"},
+		},
+		{name: "name with a dash", req: scriptRequest{Args: map[string]interface{}{"my-arg": "1"}}, err: true},
+		{name: "name with a space", req: scriptRequest{Args: map[string]interface{}{"a b": "1"}}, err: true},
+		{name: "name starting with a digit", req: scriptRequest{Args: map[string]interface{}{"1st": "1"}}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := newScriptArgs(tt.req)
+			if tt.err {
+				if !errors.Is(err, errInvalidRequest) {
+					t.Fatalf("err = %v, want %v", err, errInvalidRequest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(args.values, tt.values) {
+				t.Errorf("values = %v, want %v", args.values, tt.values)
+			}
+			if !sort.StringsAreSorted(args.names) || len(args.names) != len(tt.values) {
+				t.Errorf("names = %v, want the sorted argument names", args.names)
+			}
+			env := args.Environ(nil)
+			sort.Strings(env)
+			if len(env) != len(tt.env) || (len(env) > 0 && !reflect.DeepEqual(env, tt.env)) {
+				t.Errorf("env = %q, want %q", env, tt.env)
+			}
+		})
+	}
+}
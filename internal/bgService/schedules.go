@@ -0,0 +1,285 @@
+package bgService
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+	// Windows has no zoneinfo database for time.LoadLocation
+	_ "time/tzdata"
+
+	"github.com/robfig/cron/v3"
+)
+
+// What to do when a schedule's fire time passed while the service was stopped
+// or the PC was asleep
+const (
+	missedRunSkip    = "skip"
+	missedRunRunOnce = "run_once"
+)
+
+// missedRunGrace is how late a run may start before it counts as missed.
+const missedRunGrace = time.Minute
+
+// maxScheduleWait caps a single wait for the next fire time. Timers don't
+// advance while the PC is asleep, so the wall clock is re-checked regularly.
+const maxScheduleWait = time.Minute
+
+var errInvalidSchedule = errors.New("invalid schedule")
+
+// parseSchedule returns when schedule fires and in which timezone. Cron
+// expressions use the standard five fields or a descriptor like @daily;
+// otherwise the schedule fires every Interval seconds.
+func parseSchedule(schedule Schedule) (cron.Schedule, *time.Location, error) {
+	location := time.Local
+	if schedule.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(schedule.Timezone)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: unknown timezone '%s'", errInvalidSchedule, schedule.Timezone)
+		}
+	}
+
+	expression := strings.TrimSpace(schedule.Cron)
+	switch {
+	case expression != "" && schedule.Interval > 0:
+		return nil, nil, fmt.Errorf("%w: set either cron or interval, not both", errInvalidSchedule)
+	case expression != "":
+		spec, err := cron.ParseStandard(expression)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", errInvalidSchedule, err)
+		}
+		return spec, location, nil
+	case schedule.Interval > 0:
+		return cron.Every(time.Duration(schedule.Interval) * time.Second), location, nil
+	}
+	return nil, nil, fmt.Errorf("%w: cron or interval is required", errInvalidSchedule)
+}
+
+func checkSchedule(schedule Schedule) error {
+	if strings.TrimSpace(schedule.Name) == "" {
+		return fmt.Errorf("%w: name is required", errInvalidSchedule)
+	}
+	if schedule.Jitter < 0 {
+		return fmt.Errorf("%w: jitter can't be negative", errInvalidSchedule)
+	}
+	switch schedule.MissedRunPolicy {
+	case "", missedRunSkip, missedRunRunOnce:
+	default:
+		return fmt.Errorf("%w: unknown missed_run_policy '%s'", errInvalidSchedule, schedule.MissedRunPolicy)
+	}
+	_, _, err := parseSchedule(schedule)
+	return err
+}
+
+// commandScheduler runs one goroutine per enabled schedule that triggers the
+// schedule's script at every fire time.
+type commandScheduler struct {
+	p       *program
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	running map[int64]*scheduleRunner
+}
+
+type scheduleRunner struct {
+	schedule Schedule
+	spec     cron.Schedule
+	location *time.Location
+	stop     chan struct{}
+}
+
+func newCommandScheduler(p *program) *commandScheduler {
+	return &commandScheduler{
+		p:       p,
+		running: make(map[int64]*scheduleRunner),
+	}
+}
+
+// Sync starts schedules that became enabled, stops the ones that were disabled
+// or removed and restarts the ones that changed.
+func (s *commandScheduler) Sync(schedules Schedules) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[int64]Schedule)
+	for _, schedule := range schedules {
+		if !schedule.Enabled {
+			continue
+		}
+		wanted[schedule.ID] = schedule
+	}
+
+	for id, runner := range s.running {
+		schedule, keep := wanted[id]
+		if keep && schedule.UpdatedAt.Equal(runner.schedule.UpdatedAt) {
+			continue
+		}
+		s.p.Logger.Debug(fmt.Sprintf("Stopping schedule '%s'", runner.schedule.Name))
+		close(runner.stop)
+		delete(s.running, id)
+	}
+
+	for id, schedule := range wanted {
+		if _, exists := s.running[id]; exists {
+			continue
+		}
+		spec, location, err := parseSchedule(schedule)
+		if err != nil {
+			s.p.Logger.Error(fmt.Sprintf("Schedule '%s' is invalid, skipping: %v", schedule.Name, err))
+			continue
+		}
+		runner := &scheduleRunner{
+			schedule: schedule,
+			spec:     spec,
+			location: location,
+			stop:     make(chan struct{}),
+		}
+		s.running[id] = runner
+		s.wg.Add(1)
+		go s.run(runner)
+	}
+}
+
+// Stop stops every schedule and waits for them to exit. Scripts that were
+// already started keep running.
+func (s *commandScheduler) Stop() {
+	s.mu.Lock()
+	for id, runner := range s.running {
+		close(runner.stop)
+		delete(s.running, id)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Active returns how many schedules are running.
+func (s *commandScheduler) Active() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.running)
+}
+
+func (s *commandScheduler) run(runner *scheduleRunner) {
+	defer s.wg.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			s.p.Logger.Error(fmt.Sprintf("Recovered from panic in schedule '%s': %v\nStack trace: %s", runner.schedule.Name, r, debug.Stack()))
+		}
+	}()
+
+	schedule := runner.schedule
+	// Round(0) drops the monotonic reading so comparisons use the wall clock
+	now := time.Now().Round(0)
+	if missed, ok := missedRunAt(schedule, runner.spec, runner.location, now); ok {
+		s.p.Logger.Debug(fmt.Sprintf("Schedule '%s' missed its run at %s, running it now", schedule.Name, missed.Format(time.RFC3339)))
+		s.fire(schedule, now)
+	}
+
+	for {
+		next := runner.spec.Next(time.Now().In(runner.location))
+		if schedule.Jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(schedule.Jitter) * int64(time.Second))))
+		}
+		s.p.Logger.Debug(fmt.Sprintf("Schedule '%s' next runs at %s", schedule.Name, next.Format(time.RFC3339)))
+
+		for {
+			wait := time.Until(next.Round(0))
+			if wait <= 0 {
+				break
+			}
+			if wait > maxScheduleWait {
+				wait = maxScheduleWait
+			}
+			select {
+			case <-time.After(wait):
+			case <-runner.stop:
+				return
+			}
+		}
+
+		firedAt := time.Now().Round(0)
+		if runMissed(next, firedAt) {
+			if schedule.MissedRunPolicy != missedRunRunOnce {
+				s.p.Logger.Debug(fmt.Sprintf("Schedule '%s' missed its run at %s by %s, skipping", schedule.Name, next.Format(time.RFC3339), firedAt.Sub(next).Round(time.Second)))
+				continue
+			}
+			s.p.Logger.Debug(fmt.Sprintf("Schedule '%s' missed its run at %s, running it now", schedule.Name, next.Format(time.RFC3339)))
+		}
+		s.fire(schedule, firedAt)
+	}
+}
+
+// missedRunAt returns the first run after the schedule's last run when it was
+// missed while the service wasn't running and the schedule catches up on it.
+func missedRunAt(schedule Schedule, spec cron.Schedule, location *time.Location, now time.Time) (time.Time, bool) {
+	if schedule.LastRunAt.IsZero() || schedule.MissedRunPolicy != missedRunRunOnce {
+		return time.Time{}, false
+	}
+	missed := spec.Next(schedule.LastRunAt.In(location))
+	return missed, runMissed(missed, now)
+}
+
+// runMissed reports whether a run due at scheduled and starting at startedAt is
+// too late to count as on time.
+func runMissed(scheduled, startedAt time.Time) bool {
+	return startedAt.Sub(scheduled) > missedRunGrace
+}
+
+// fire starts the schedule's script without waiting for it, so a slow script
+// doesn't delay the next fire time. Overlapping runs follow the script's
+// concurrency policy.
+func (s *commandScheduler) fire(schedule Schedule, at time.Time) {
+	if err := s.p.db.UpdateScheduleLastRun(schedule.ID, at.UTC()); err != nil {
+		s.p.Logger.Error(fmt.Sprintf("Failed to record last run of schedule '%s': %v", schedule.Name, err))
+	}
+
+	command, ok := s.p.scriptCommandName(schedule.ScriptID)
+	if !ok {
+		s.p.Logger.Error(fmt.Sprintf("Schedule '%s' refers to script %d, which doesn't exist", schedule.Name, schedule.ScriptID))
+		return
+	}
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				s.p.Logger.Error(fmt.Sprintf("Recovered from panic in schedule '%s': %v\nStack trace: %s", schedule.Name, r, debug.Stack()))
+			}
+		}()
+
+		s.p.Logger.Info("Schedule running command", "schedule", schedule.Name, "command", command)
+		run, err := s.p.runScript(scriptRequest{
+			Command:   command,
+			RequestID: fmt.Sprintf("schedule-%d", schedule.ID),
+			Source:    runSourceSchedule,
+		})
+		if err != nil {
+			s.p.Logger.Error(fmt.Sprintf("Scheduled command '%s' of schedule '%s' failed: %v", command, schedule.Name, err))
+			return
+		}
+		s.p.Logger.Debug(fmt.Sprintf("Scheduled command '%s' of schedule '%s' finished with status %s", command, schedule.Name, run.Status))
+	}()
+}
+
+// reloadSchedules re-reads the schedules table and applies it to the running
+// scheduler.
+func (p *program) reloadSchedules() error {
+	p.reloadMutex.Lock()
+	defer p.reloadMutex.Unlock()
+	return p.loadSchedules()
+}
+
+// loadSchedules is reloadSchedules for callers that hold reloadMutex.
+func (p *program) loadSchedules() error {
+	schedules, err := p.db.GetSchedules()
+	if err != nil {
+		return fmt.Errorf("failed to get schedules: %v", err)
+	}
+
+	if p.schedules != nil {
+		p.schedules.Sync(*schedules)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package bgService
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	from := time.Date(2026, 3, 10, 8, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		schedule Schedule
+		// next is the first fire time after from, in UTC
+		next time.Time
+		err  bool
+	}{
+		{
+			name:     "cron",
+			schedule: Schedule{Cron: "0 9 * * *", Timezone: "UTC"},
+			next:     time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "cron in a timezone",
+			schedule: Schedule{Cron: "0 9 * * *", Timezone: "Europe/Berlin"},
+			next:     time.Date(2026, 3, 11, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "cron with surrounding spaces",
+			schedule: Schedule{Cron: " */15 * * * * ", Timezone: "UTC"},
+			next:     time.Date(2026, 3, 10, 8, 45, 0, 0, time.UTC),
+		},
+		{
+			name:     "interval",
+			schedule: Schedule{Interval: 90, Timezone: "UTC"},
+			next:     time.Date(2026, 3, 10, 8, 31, 30, 0, time.UTC),
+		},
+		{name: "cron and interval", schedule: Schedule{Cron: "* * * * *", Interval: 60}, err: true},
+		{name: "neither", schedule: Schedule{}, err: true},
+		{name: "invalid cron", schedule: Schedule{Cron: "every day"}, err: true},
+		{name: "seconds field", schedule: Schedule{Cron: "0 0 9 * * *"}, err: true},
+		{name: "unknown timezone", schedule: Schedule{Cron: "0 9 * * *", Timezone: "Mars/Olympus"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, location, err := parseSchedule(tt.schedule)
+			if tt.err {
+				if !errors.Is(err, errInvalidSchedule) {
+					t.Fatalf("err = %v, want %v", err, errInvalidSchedule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next := spec.Next(from.In(location)); !next.Equal(tt.next) {
+				t.Errorf("next = %s, want %s", next.UTC(), tt.next)
+			}
+		})
+	}
+}
+
+func TestCheckSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule Schedule
+		err      bool
+	}{
+		{name: "valid", schedule: Schedule{Name: "backup", Interval: 60}},
+		{name: "run once", schedule: Schedule{Name: "backup", Interval: 60, MissedRunPolicy: missedRunRunOnce}},
+		{name: "no name", schedule: Schedule{Name: " ", Interval: 60}, err: true},
+		{name: "negative jitter", schedule: Schedule{Name: "backup", Interval: 60, Jitter: -1}, err: true},
+		{name: "unknown policy", schedule: Schedule{Name: "backup", Interval: 60, MissedRunPolicy: "always"}, err: true},
+		{name: "no cron or interval", schedule: Schedule{Name: "backup"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSchedule(tt.schedule)
+			if tt.err != (err != nil) {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if err != nil && !errors.Is(err, errInvalidSchedule) {
+				t.Errorf("err = %v, want %v", err, errInvalidSchedule)
+			}
+		})
+	}
+}
+
+func TestMissedRunAt(t *testing.T) {
+	spec, location, err := parseSchedule(Schedule{Cron: "0 9 * * *", Timezone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastRun := time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		schedule Schedule
+		now      time.Time
+		missed   time.Time
+		ok       bool
+	}{
+		{
+			name:     "run once catches up",
+			schedule: Schedule{LastRunAt: lastRun, MissedRunPolicy: missedRunRunOnce},
+			now:      time.Date(2026, 3, 12, 12, 0, 0, 0, time.UTC),
+			missed:   time.Date(2026, 3, 11, 9, 0, 0, 0, time.UTC),
+			ok:       true,
+		},
+		{
+			name:     "skip doesn't catch up",
+			schedule: Schedule{LastRunAt: lastRun, MissedRunPolicy: missedRunSkip},
+			now:      time.Date(2026, 3, 12, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "default policy skips",
+			schedule: Schedule{LastRunAt: lastRun},
+			now:      time.Date(2026, 3, 12, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "never ran",
+			schedule: Schedule{MissedRunPolicy: missedRunRunOnce},
+			now:      time.Date(2026, 3, 12, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "next run not due yet",
+			schedule: Schedule{LastRunAt: lastRun, MissedRunPolicy: missedRunRunOnce},
+			now:      time.Date(2026, 3, 11, 8, 0, 0, 0, time.UTC),
+			missed:   time.Date(2026, 3, 11, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "within the grace period",
+			schedule: Schedule{LastRunAt: lastRun, MissedRunPolicy: missedRunRunOnce},
+			now:      time.Date(2026, 3, 11, 9, 0, 30, 0, time.UTC),
+			missed:   time.Date(2026, 3, 11, 9, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missed, ok := missedRunAt(tt.schedule, spec, location, tt.now)
+			if ok != tt.ok || !missed.Equal(tt.missed) {
+				t.Errorf("missedRunAt = %s, %v, want %s, %v", missed, ok, tt.missed, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRunMissed(t *testing.T) {
+	scheduled := time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		late   time.Duration
+		missed bool
+	}{
+		{late: 0},
+		{late: -time.Second},
+		{late: missedRunGrace},
+		{late: missedRunGrace + time.Second, missed: true},
+		{late: time.Hour, missed: true},
+	}
+	for _, tt := range tests {
+		if missed := runMissed(scheduled, scheduled.Add(tt.late)); missed != tt.missed {
+			t.Errorf("runMissed late by %s = %v, want %v", tt.late, missed, tt.missed)
+		}
+	}
+}
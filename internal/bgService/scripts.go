@@ -0,0 +1,166 @@
+package bgService
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxScriptSize caps the size of uploaded script content.
+const maxScriptSize = 1 << 20
+
+var errInvalidScriptPath = errors.New("invalid script path")
+
+// scriptFilePath validates a script_path and returns where it lives on disk.
+// Only plain file names are accepted, so a script can never be written or read
+// outside of p.scriptDir.
+func (p *program) scriptFilePath(scriptPath string) (string, error) {
+	if scriptPath == "" || scriptPath == "." || scriptPath == ".." ||
+		strings.ContainsAny(scriptPath, `/\:`) || filepath.Base(scriptPath) != scriptPath {
+		return "", fmt.Errorf("%w: %q", errInvalidScriptPath, scriptPath)
+	}
+
+	fullPath := filepath.Join(p.scriptDir, scriptPath)
+	rel, err := filepath.Rel(p.scriptDir, fullPath)
+	if err != nil || rel != scriptPath {
+		return "", fmt.Errorf("%w: %q", errInvalidScriptPath, scriptPath)
+	}
+	return fullPath, nil
+}
+
+// writeScriptFile writes the script content through a temporary file and a
+// rename, so a running script never sees a half-written file.
+func (p *program) writeScriptFile(scriptPath string, content []byte) error {
+	fullPath, err := p.scriptFilePath(scriptPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(p.scriptDir, 0755); err != nil {
+		return fmt.Errorf("failed to create scripts directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(p.scriptDir, ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write script: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write script: %v", err)
+	}
+	// CreateTemp creates the file owner-only, but scripts may run as the
+	// logged in user and plain executables need the execute bit
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return fmt.Errorf("failed to set script permissions: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), fullPath); err != nil {
+		return fmt.Errorf("failed to move script into place: %v", err)
+	}
+	return nil
+}
+
+func (p *program) readScriptFile(scriptPath string) ([]byte, error) {
+	fullPath, err := p.scriptFilePath(scriptPath)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(fullPath)
+}
+
+func (p *program) removeScriptFile(scriptPath string) error {
+	fullPath, err := p.scriptFilePath(scriptPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// renameScriptFile moves a script file. It fails with os.ErrExist rather than
+// replace another file.
+func (p *program) renameScriptFile(oldPath, newPath string) error {
+	oldFullPath, err := p.scriptFilePath(oldPath)
+	if err != nil {
+		return err
+	}
+	newFullPath, err := p.scriptFilePath(newPath)
+	if err != nil {
+		return err
+	}
+	// os.Rename silently replaces an existing target
+	exists, err := p.scriptFileExists(newPath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w: %s", os.ErrExist, newPath)
+	}
+	return os.Rename(oldFullPath, newFullPath)
+}
+
+func (p *program) scriptFileExists(scriptPath string) (bool, error) {
+	fullPath, err := p.scriptFilePath(scriptPath)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// scriptPathInUse reports whether a registered script other than the one with
+// id exceptID runs scriptPath. Pass 0 to check every script.
+func (p *program) scriptPathInUse(scriptPath string, exceptID int64) bool {
+	scriptConfigs, err := p.db.GetScriptConfigs()
+	if err != nil {
+		// Err on the side of keeping the file
+		return true
+	}
+	for _, sc := range *scriptConfigs {
+		if sc.ScriptPath == scriptPath && sc.ID != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+// scriptNameConflict returns the name of another script that name clashes
+// with, or "" if there is none. Names clash when they are equal, since
+// Config.Commands is keyed by name, or when they map to the same discovery id,
+// since both would publish their Home Assistant button to the same topic.
+func (p *program) scriptNameConflict(name string, id int64) (string, error) {
+	scriptConfigs, err := p.db.GetScriptConfigs()
+	if err != nil {
+		return "", err
+	}
+	for _, sc := range *scriptConfigs {
+		if sc.ID != id && (sc.Name == name || discoveryID(sc.Name) == discoveryID(name)) {
+			return sc.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// scriptCommandName returns the command name of the script with the given id,
+// for schedules and rules that refer to scripts by id so renames don't break
+// them.
+func (p *program) scriptCommandName(scriptID int64) (string, bool) {
+	for name, sc := range p.currentConfig().Commands {
+		if sc.ID == scriptID {
+			return name, true
+		}
+	}
+	return "", false
+}
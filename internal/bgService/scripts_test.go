@@ -0,0 +1,170 @@
+package bgService
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestScriptFilePath(t *testing.T) {
+	dir := t.TempDir()
+	p := &program{scriptDir: dir}
+	tests := []struct {
+		scriptPath string
+		valid      bool
+	}{
+		{scriptPath: "backup.ps1", valid: true},
+		{scriptPath: "shutdown", valid: true},
+		{scriptPath: ".hidden.sh", valid: true},
+		{scriptPath: "two..dots.py", valid: true},
+		{scriptPath: ""},
+		{scriptPath: "."},
+		{scriptPath: ".."},
+		{scriptPath: "../secret.txt"},
+		{scriptPath: `..\secret.txt`},
+		{scriptPath: "sub/script.sh"},
+		{scriptPath: `sub\script.ps1`},
+		{scriptPath: "/etc/passwd"},
+		{scriptPath: `C:\Windows\win.ini`},
+		{scriptPath: "C:script.ps1"},
+		{scriptPath: "script.ps1:stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scriptPath, func(t *testing.T) {
+			fullPath, err := p.scriptFilePath(tt.scriptPath)
+			if !tt.valid {
+				if !errors.Is(err, errInvalidScriptPath) {
+					t.Fatalf("err = %v, want %v", err, errInvalidScriptPath)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(dir, tt.scriptPath); fullPath != want {
+				t.Errorf("path = %q, want %q", fullPath, want)
+			}
+		})
+	}
+}
+
+func TestRenameScriptFile(t *testing.T) {
+	dir := t.TempDir()
+	p := &program{scriptDir: dir}
+	for _, name := range []string{"a.sh", "b.sh"} {
+		if err := p.writeScriptFile(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.renameScriptFile("a.sh", "b.sh"); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("rename onto an existing file: err = %v, want %v", err, os.ErrExist)
+	}
+	if content, _ := p.readScriptFile("b.sh"); string(content) != "b.sh" {
+		t.Fatalf("existing file was overwritten with %q", content)
+	}
+	if err := p.renameScriptFile("a.sh", "../c.sh"); !errors.Is(err, errInvalidScriptPath) {
+		t.Fatalf("rename out of the scripts directory: err = %v, want %v", err, errInvalidScriptPath)
+	}
+
+	if err := p.renameScriptFile("a.sh", "c.sh"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := p.scriptFileExists("a.sh"); exists {
+		t.Error("old file still exists after the rename")
+	}
+	if content, _ := p.readScriptFile("c.sh"); string(content) != "a.sh" {
+		t.Errorf("renamed file has content %q, want %q", content, "a.sh")
+	}
+}
+
+func TestScriptNameConflict(t *testing.T) {
+	p, _ := newTestProgram(t, Config{BrokerAddress: "tcp://localhost:1883", ClientID: "office"})
+	lock := ScriptConfig{Name: "Lock PC", ScriptPath: "lock.sh", Concurrency: concurrencyParallel}
+	if err := p.db.CreateScriptConfig(&lock); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		id       int64
+		conflict string
+	}{
+		{name: "Lock PC", conflict: "Lock PC"},
+		{name: "lock pc", conflict: "Lock PC"},
+		{name: "lock_pc", conflict: "Lock PC"},
+		{name: " Lock PC! ", conflict: "Lock PC"},
+		{name: "lock-pc"},
+		{name: "Unlock PC"},
+		// Renaming a script may keep its discovery id
+		{name: "lock pc", id: lock.ID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conflict, err := p.scriptNameConflict(tt.name, tt.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conflict != tt.conflict {
+				t.Errorf("conflict = %q, want %q", conflict, tt.conflict)
+			}
+
+			w := httptest.NewRecorder()
+			valid := p.validateScript(w, ScriptConfig{ID: tt.id, Name: tt.name, ScriptPath: "other.sh", Concurrency: concurrencyParallel})
+			if valid != (tt.conflict == "") {
+				t.Errorf("validateScript = %v, want %v", valid, tt.conflict == "")
+			}
+			if !valid && w.Code != http.StatusConflict {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusConflict)
+			}
+		})
+	}
+}
+
+func TestHandleUpdateScriptRestoresFileWhenSaveFails(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "new content", body: `{"name": "backup", "script_path": "backup.sh", "content": "echo new"}`},
+		{name: "rename", body: `{"name": "backup", "script_path": "moved.sh"}`},
+		{name: "rename with new content", body: `{"name": "backup", "script_path": "moved.sh", "content": "echo new"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProgram(t, Config{BrokerAddress: "tcp://localhost:1883"})
+			if err := p.writeScriptFile("backup.sh", []byte("echo old")); err != nil {
+				t.Fatal(err)
+			}
+			script := ScriptConfig{Name: "backup", ScriptPath: "backup.sh", Concurrency: concurrencyParallel}
+			if err := p.db.CreateScriptConfig(&script); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.db.Exec("CREATE TRIGGER fail_update BEFORE UPDATE ON script_configs BEGIN SELECT RAISE(ABORT, 'disk full'); END"); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("PUT", "/api/scripts/1", strings.NewReader(tt.body))
+			r = mux.SetURLVars(r, map[string]string{"id": strconv.FormatInt(script.ID, 10)})
+			w := httptest.NewRecorder()
+			p.handleUpdateScript(w, r)
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+			}
+
+			if content, err := p.readScriptFile("backup.sh"); err != nil || string(content) != "echo old" {
+				t.Errorf("backup.sh = %q, %v, want the old content", content, err)
+			}
+			if exists, _ := p.scriptFileExists("moved.sh"); exists {
+				t.Error("moved.sh exists, but the config still points at backup.sh")
+			}
+		})
+	}
+}
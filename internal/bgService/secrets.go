@@ -0,0 +1,91 @@
+package bgService
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// encryptedSecretPrefix marks a stored secret as encrypted with the
+// machine-local key. Values without it are plaintext from older versions.
+const encryptedSecretPrefix = "enc:v1:"
+
+// secretPlaceholder is returned by the API instead of a stored secret. Posting
+// it back, or nothing, keeps the stored value.
+const secretPlaceholder = "********"
+
+func isEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, encryptedSecretPrefix)
+}
+
+// encryptSecret encrypts a secret for storage in the database.
+func encryptSecret(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	ciphertext, err := protectSecret([]byte(plaintext))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt secret: %v", err)
+	}
+	return encryptedSecretPrefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// decryptSecret returns the plaintext of a stored secret. Plaintext values are
+// returned as they are.
+func decryptSecret(value string) (string, error) {
+	if !isEncryptedSecret(value) {
+		return value, nil
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedSecretPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret: %v", err)
+	}
+	plaintext, err := unprotectSecret(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// postedPassword returns the broker password to store for a config posted to
+// the API. The password is write-only: the dashboard shows the placeholder or
+// nothing, so an empty or absent password, or the placeholder, keeps the stored
+// one. Clearing the username clears the password too.
+func postedPassword(posted Config, stored string) (string, error) {
+	if posted.Username == "" {
+		return "", nil
+	}
+	if posted.Password == "" || posted.Password == secretPlaceholder {
+		return stored, nil
+	}
+	return encryptSecret(posted.Password)
+}
+
+// redactSecret returns what the API shows for a stored secret.
+func redactSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return secretPlaceholder
+}
+
+// encryptStoredSecrets encrypts the broker password when it is still stored in
+// plaintext by an older version.
+func (p *program) encryptStoredSecrets() error {
+	config := p.currentConfig()
+	if config.Password == "" || isEncryptedSecret(config.Password) {
+		return nil
+	}
+
+	encrypted, err := encryptSecret(config.Password)
+	if err != nil {
+		return err
+	}
+	config.Password = encrypted
+	if err := p.db.UpdateConfig(&config); err != nil {
+		return fmt.Errorf("failed to save encrypted password: %v", err)
+	}
+	p.setConfig(config)
+	p.Logger.Debug("Encrypted the stored MQTT password")
+	return nil
+}
@@ -0,0 +1,125 @@
+package bgService
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncryptSecret(t *testing.T) {
+	encrypted, err := encryptSecret("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedSecret(encrypted) || strings.Contains(encrypted, "hunter2") {
+		t.Fatalf("encrypted = %q, want an %q value without the plaintext", encrypted, encryptedSecretPrefix)
+	}
+	if again, _ := encryptSecret("hunter2"); again == encrypted {
+		t.Error("encrypting twice gave the same value, the nonce isn't random")
+	}
+
+	plaintext, err := decryptSecret(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "hunter2" {
+		t.Errorf("decrypted = %q, want %q", plaintext, "hunter2")
+	}
+
+	if empty, err := encryptSecret(""); err != nil || empty != "" {
+		t.Errorf("encryptSecret(\"\") = %q, %v, want no value", empty, err)
+	}
+}
+
+func TestDecryptSecret(t *testing.T) {
+	for _, value := range []string{"", "hunter2", "enc:v2:abc"} {
+		plaintext, err := decryptSecret(value)
+		if err != nil || plaintext != value {
+			t.Errorf("decryptSecret(%q) = %q, %v, want plaintext passed through", value, plaintext, err)
+		}
+	}
+	for _, value := range []string{encryptedSecretPrefix + "not base64!", encryptedSecretPrefix + "c2hvcnQ="} {
+		if _, err := decryptSecret(value); err == nil {
+			t.Errorf("decryptSecret(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestPostedPassword(t *testing.T) {
+	stored, err := encryptSecret("stored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		posted   Config
+		want     string
+		replaced bool
+	}{
+		{name: "placeholder", posted: Config{Username: "user", Password: secretPlaceholder}, want: stored},
+		{name: "empty", posted: Config{Username: "user"}, want: stored},
+		{name: "new password", posted: Config{Username: "user", Password: "changed"}, want: "changed", replaced: true},
+		{name: "username cleared", posted: Config{Password: secretPlaceholder}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			password, err := postedPassword(tt.posted, stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.replaced {
+				if password != tt.want {
+					t.Errorf("password = %q, want %q", password, tt.want)
+				}
+				return
+			}
+			if !isEncryptedSecret(password) {
+				t.Fatalf("password = %q, want it encrypted", password)
+			}
+			if plaintext, _ := decryptSecret(password); plaintext != tt.want {
+				t.Errorf("password decrypts to %q, want %q", plaintext, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactSecret(t *testing.T) {
+	if got := redactSecret(""); got != "" {
+		t.Errorf("redactSecret(\"\") = %q, want no value", got)
+	}
+	if got := redactSecret("enc:v1:abc"); got != secretPlaceholder {
+		t.Errorf("redactSecret = %q, want %q", got, secretPlaceholder)
+	}
+}
+
+func TestEncryptStoredSecrets(t *testing.T) {
+	p, _ := newTestProgram(t, Config{BrokerAddress: "tcp://localhost:1883", Username: "user", Password: "plaintext"})
+	if err := p.encryptStoredSecrets(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := p.db.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedSecret(stored.Password) {
+		t.Fatalf("stored password = %q, want it encrypted", stored.Password)
+	}
+	if plaintext, _ := decryptSecret(stored.Password); plaintext != "plaintext" {
+		t.Errorf("stored password decrypts to %q, want %q", plaintext, "plaintext")
+	}
+	if p.currentConfig().Password != stored.Password {
+		t.Error("the loaded config still has the plaintext password")
+	}
+
+	// An encrypted password is left as it is on the next start
+	if err := p.encryptStoredSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := p.db.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Password != stored.Password {
+		t.Errorf("password was encrypted again: %q, was %q", again.Password, stored.Password)
+	}
+}
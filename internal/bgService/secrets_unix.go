@@ -0,0 +1,115 @@
+//go:build !windows
+
+package bgService
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// secretKeyFile holds the key that encrypts stored secrets, relative to the
+// executable. Only root can read it.
+const secretKeyFile = "data/secret.key"
+
+var (
+	secretKeyOnce sync.Once
+	secretKey     []byte
+	secretKeyErr  error
+)
+
+// loadSecretKey reads the key file, creating it with a random key the first
+// time.
+func loadSecretKey() ([]byte, error) {
+	secretKeyOnce.Do(func() {
+		path := resolveConfigPath(secretKeyFile)
+		key, err := os.ReadFile(path)
+		if err == nil {
+			if len(key) != 32 {
+				secretKeyErr = fmt.Errorf("%s doesn't contain a 256-bit key", path)
+				return
+			}
+			secretKey = key
+			return
+		}
+		if !os.IsNotExist(err) {
+			secretKeyErr = fmt.Errorf("failed to read %s: %v", path, err)
+			return
+		}
+
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			secretKeyErr = fmt.Errorf("failed to generate key: %v", err)
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			secretKeyErr = fmt.Errorf("failed to create key directory: %v", err)
+			return
+		}
+		// O_EXCL so a key written concurrently by the systray isn't overwritten
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			key, err = os.ReadFile(path)
+			if err != nil || len(key) != 32 {
+				secretKeyErr = fmt.Errorf("failed to read %s: %v", path, err)
+				return
+			}
+			secretKey = key
+			return
+		}
+		if err != nil {
+			secretKeyErr = fmt.Errorf("failed to create %s: %v", path, err)
+			return
+		}
+		defer f.Close()
+		if _, err := f.Write(key); err != nil {
+			secretKeyErr = fmt.Errorf("failed to write %s: %v", path, err)
+			return
+		}
+		secretKey = key
+	})
+	return secretKey, secretKeyErr
+}
+
+func newSecretCipher() (cipher.AEAD, error) {
+	key, err := loadSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// protectSecret encrypts data with AES-GCM. The nonce is prepended to the
+// ciphertext.
+func protectSecret(data []byte) ([]byte, error) {
+	gcm, err := newSecretCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func unprotectSecret(data []byte) ([]byte, error) {
+	gcm, err := newSecretCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,41 @@
+package bgService
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// protectSecret encrypts data with DPAPI using the machine key, so only
+// processes on this PC can decrypt it, whichever account they run as.
+func protectSecret(data []byte) ([]byte, error) {
+	return cryptData(data, true)
+}
+
+func unprotectSecret(data []byte) ([]byte, error) {
+	return cryptData(data, false)
+}
+
+func cryptData(data []byte, protect bool) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	in := windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+	var out windows.DataBlob
+	flags := uint32(windows.CRYPTPROTECT_UI_FORBIDDEN | windows.CRYPTPROTECT_LOCAL_MACHINE)
+
+	var err error
+	if protect {
+		err = windows.CryptProtectData(&in, nil, nil, 0, nil, flags, &out)
+	} else {
+		err = windows.CryptUnprotectData(&in, nil, nil, 0, nil, flags, &out)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+
+	result := make([]byte, out.Size)
+	copy(result, unsafe.Slice(out.Data, out.Size))
+	return result, nil
+}
@@ -0,0 +1,179 @@
+package bgService
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// sensorScheduler runs one publishing goroutine per enabled sensor_configs row.
+type sensorScheduler struct {
+	p       *program
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	running map[int64]*sensorRunner
+}
+
+type sensorRunner struct {
+	config SensorConfig
+	stop   chan struct{}
+}
+
+func newSensorScheduler(p *program) *sensorScheduler {
+	return &sensorScheduler{
+		p:       p,
+		running: make(map[int64]*sensorRunner),
+	}
+}
+
+// Sync starts sensors that became enabled, stops the ones that were disabled or
+// removed and restarts the ones whose interval, topic or name changed.
+func (s *sensorScheduler) Sync(configs SensorConfigs) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[int64]SensorConfig)
+	for _, sc := range configs {
+		if !sc.Enabled {
+			continue
+		}
+		if sc.Interval <= 0 {
+			s.p.Logger.Error(fmt.Sprintf("Sensor '%s' has an invalid interval of %d seconds, skipping", sc.Name, sc.Interval))
+			continue
+		}
+		if _, exists := sensorCollectors[sc.Name]; !exists {
+			s.p.Logger.Error(fmt.Sprintf("Sensor '%s' is not a known sensor, skipping", sc.Name))
+			continue
+		}
+		wanted[sc.ID] = sc
+	}
+
+	for id, runner := range s.running {
+		sc, keep := wanted[id]
+		if keep && sc.Name == runner.config.Name && sc.Interval == runner.config.Interval && sc.SensorTopic == runner.config.SensorTopic {
+			continue
+		}
+		s.p.Logger.Debug(fmt.Sprintf("Stopping sensor '%s'", runner.config.Name))
+		close(runner.stop)
+		delete(s.running, id)
+	}
+
+	for id, sc := range wanted {
+		if _, exists := s.running[id]; exists {
+			continue
+		}
+		runner := &sensorRunner{
+			config: sc,
+			stop:   make(chan struct{}),
+		}
+		s.running[id] = runner
+		s.wg.Add(1)
+		go s.run(runner)
+	}
+}
+
+// Stop stops every running sensor and waits for them to exit.
+func (s *sensorScheduler) Stop() {
+	s.mu.Lock()
+	for id, runner := range s.running {
+		close(runner.stop)
+		delete(s.running, id)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Active returns how many sensors are running.
+func (s *sensorScheduler) Active() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.running)
+}
+
+func (s *sensorScheduler) run(runner *sensorRunner) {
+	defer s.wg.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			s.p.Logger.Error(fmt.Sprintf("Recovered from panic in sensor '%s': %v\nStack trace: %s", runner.config.Name, r, debug.Stack()))
+		}
+	}()
+
+	s.p.Logger.Debug(fmt.Sprintf("Starting sensor '%s' every %d seconds", runner.config.Name, runner.config.Interval))
+
+	ticker := time.NewTicker(time.Duration(runner.config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		s.p.publishSensorData(runner.config)
+
+		select {
+		case <-ticker.C:
+		case <-runner.stop:
+			return
+		}
+	}
+}
+
+func (p *program) sensorTopic(sc SensorConfig) string {
+	if sc.SensorTopic != "" {
+		return sc.SensorTopic
+	}
+	return commandTopic(p.currentConfig()) + "/sensors/" + sc.Name
+}
+
+func (p *program) publishSensorData(sc SensorConfig) {
+	client := p.currentMQTTClient()
+	if client == nil || !client.IsConnected() {
+		p.Logger.Debug(fmt.Sprintf("MQTT client not connected, skipping sensor '%s'", sc.Name))
+		return
+	}
+
+	reading, err := collectSensor(sc.Name)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to collect sensor '%s': %v", sc.Name, err))
+		return
+	}
+
+	jsonData, err := json.Marshal(reading)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to marshal sensor '%s': %v", sc.Name, err))
+		return
+	}
+
+	topic := p.sensorTopic(sc)
+	if token := client.Publish(topic, 0, false, jsonData); token.Wait() && token.Error() != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to publish sensor '%s': %v", sc.Name, token.Error()))
+	} else {
+		p.Logger.Debug(fmt.Sprintf("Successfully published sensor '%s' to %s", sc.Name, topic))
+	}
+}
+
+// reloadSensors re-reads sensor_configs and applies it to the running scheduler.
+func (p *program) reloadSensors() error {
+	p.reloadMutex.Lock()
+	defer p.reloadMutex.Unlock()
+	return p.loadSensors()
+}
+
+// loadSensors is reloadSensors for callers that hold reloadMutex.
+func (p *program) loadSensors() error {
+	sensorConfigs, err := p.db.GetSensorConfigs()
+	if err != nil {
+		return fmt.Errorf("failed to get sensor configs: %v", err)
+	}
+
+	sensors := make(map[string]SensorConfig)
+	for _, sc := range *sensorConfigs {
+		sensors[sc.SensorTopic] = sc
+	}
+	config := p.currentConfig()
+	config.Sensors = sensors
+	p.setConfig(config)
+
+	if p.sensors != nil {
+		p.sensors.Sync(*sensorConfigs)
+	}
+	return nil
+}
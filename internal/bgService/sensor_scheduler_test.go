@@ -0,0 +1,75 @@
+package bgService
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestSensorTopic(t *testing.T) {
+	p := &program{}
+	p.config.Topic = "home"
+	p.config.ClientID = "office"
+
+	if topic, want := p.sensorTopic(SensorConfig{Name: "cpu_usage"}), "winsense/home/office/sensors/cpu_usage"; topic != want {
+		t.Errorf("default topic = %q, want %q", topic, want)
+	}
+	if topic, want := p.sensorTopic(SensorConfig{Name: "cpu_usage", SensorTopic: "custom/cpu"}), "custom/cpu"; topic != want {
+		t.Errorf("configured topic = %q, want %q", topic, want)
+	}
+}
+
+func TestSensorSchedulerSync(t *testing.T) {
+	p := &program{Logger: discardLogger{}}
+	s := newSensorScheduler(p)
+	defer s.Stop()
+
+	running := func() []int64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var ids []int64
+		for id := range s.running {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids
+	}
+	runner := func(id int64) *sensorRunner {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.running[id]
+	}
+
+	configs := SensorConfigs{
+		{ID: 1, Name: "cpu_usage", Enabled: true, Interval: 60},
+		{ID: 2, Name: "memory_usage", Enabled: false, Interval: 60},
+		{ID: 3, Name: "disk_usage", Enabled: true, Interval: 0},
+		{ID: 4, Name: "no_such_sensor", Enabled: true, Interval: 60},
+		{ID: 5, Name: "uptime", Enabled: true, Interval: 300},
+	}
+	s.Sync(configs)
+	if ids := running(); len(ids) != 2 || ids[0] != 1 || ids[1] != 5 {
+		t.Fatalf("running sensors = %v, want [1 5]", ids)
+	}
+
+	// An unchanged sensor keeps running, a changed one restarts
+	first, uptime := runner(1), runner(5)
+	configs[4].Interval = 600
+	s.Sync(configs)
+	if runner(1) != first {
+		t.Error("unchanged sensor was restarted")
+	}
+	if runner(5) == uptime {
+		t.Error("sensor with a new interval wasn't restarted")
+	}
+
+	configs[0].Enabled = false
+	s.Sync(configs)
+	if ids := running(); len(ids) != 1 || ids[0] != 5 {
+		t.Fatalf("running sensors after disabling = %v, want [5]", ids)
+	}
+
+	s.Sync(nil)
+	if ids := running(); len(ids) != 0 {
+		t.Fatalf("running sensors after removing all = %v, want none", ids)
+	}
+}
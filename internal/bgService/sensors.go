@@ -2,9 +2,7 @@ package bgService
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"os/exec"
 	"time"
 
 	"github.com/shirou/gopsutil/v4/cpu"
@@ -33,33 +31,75 @@ type TemperatureData struct {
 	Temperature float64 `json:"Temperature"`
 }
 
+type SensorReading struct {
+	Name      string      `json:"name"`
+	Value     interface{} `json:"value"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+type sensorCollector func() (interface{}, error)
+
+// sensorCollectors maps the name of a sensor_configs row to the function that
+// reads it. "all" publishes the complete SensorData blob.
+var sensorCollectors = map[string]sensorCollector{
+	"all":             func() (interface{}, error) { return collectSensorData() },
+	"cpu_usage":       func() (interface{}, error) { return getCPUUsage() },
+	"cpu_info":        func() (interface{}, error) { return getCPUInfo() },
+	"cpu_temperature": func() (interface{}, error) { return getCPUTemperature() },
+	"memory_usage":    func() (interface{}, error) { return getMemoryUsage() },
+	"disk_usage":      func() (interface{}, error) { return getDiskUsage() },
+	"disk_partitions": func() (interface{}, error) { return disk.Partitions(false) },
+	"net_connections": func() (interface{}, error) { return net.Connections("all") },
+	"uptime":          func() (interface{}, error) { return host.Uptime() },
+	"users":           func() (interface{}, error) { return host.Users() },
+	"sensors":         func() (interface{}, error) { return sensors.TemperaturesWithContext(context.Background()) },
+}
+
+func collectSensor(name string) (SensorReading, error) {
+	collector, exists := sensorCollectors[name]
+	if !exists {
+		return SensorReading{}, fmt.Errorf("unknown sensor: %s", name)
+	}
+
+	value, err := collector()
+	if err != nil {
+		return SensorReading{}, err
+	}
+
+	return SensorReading{
+		Name:      name,
+		Value:     value,
+		Timestamp: time.Now(),
+	}, nil
+}
+
 func collectSensorData() (SensorData, error) {
 	data := SensorData{
 		Timestamp: time.Now(),
 	}
 
 	// CPU Usage
-	cpuPercent, err := cpu.Percent(time.Second, false)
-	if err == nil && len(cpuPercent) > 0 {
-		data.CPUUsage = cpuPercent[0]
+	cpuPercent, err := getCPUUsage()
+	if err == nil {
+		data.CPUUsage = cpuPercent
 	}
 
 	// CPU Info
-	cpuInfo, err := cpu.Info()
-	if err == nil && len(cpuInfo) > 0 {
-		data.CPUInfo = cpuInfo[0]
+	cpuInfo, err := getCPUInfo()
+	if err == nil {
+		data.CPUInfo = cpuInfo
 	}
 
 	// Memory Usage
-	memInfo, err := mem.VirtualMemory()
+	memUsage, err := getMemoryUsage()
 	if err == nil {
-		data.MemoryUsage = memInfo.UsedPercent
+		data.MemoryUsage = memUsage
 	}
 
 	// Disk Usage
-	diskInfo, err := disk.Usage("C:")
+	diskUsage, err := getDiskUsage()
 	if err == nil {
-		data.DiskUsage = diskInfo.UsedPercent
+		data.DiskUsage = diskUsage
 	}
 
 	// Disk Partitions
@@ -75,9 +115,9 @@ func collectSensorData() (SensorData, error) {
 	}
 
 	// Uptime
-	hostInfo, err := host.Info()
+	uptime, err := host.Uptime()
 	if err == nil {
-		data.Uptime = hostInfo.Uptime
+		data.Uptime = uptime
 	}
 
 	// Users
@@ -103,31 +143,40 @@ func collectSensorData() (SensorData, error) {
 	return data, nil
 }
 
-func getCPUTemperature() (float64, error) {
-	cmd := exec.Command("powershell", "-Command", `
-		$temp = Get-WmiObject MSAcpi_ThermalZoneTemperature -Namespace "root/wmi" | Select-Object -First 1
-		if ($temp) {
-			$celsius = ($temp.CurrentTemperature / 10) - 273.15
-			ConvertTo-Json @{ Temperature = [math]::Round($celsius, 2) }
-		} else {
-			ConvertTo-Json @{ Temperature = $null }
-		}
-	`)
-
-	output, err := cmd.Output()
+func getCPUUsage() (float64, error) {
+	cpuPercent, err := cpu.Percent(time.Second, false)
 	if err != nil {
-		return 0, fmt.Errorf("failed to execute PowerShell command: %v", err)
+		return 0, err
 	}
+	if len(cpuPercent) == 0 {
+		return 0, fmt.Errorf("cpu usage not available")
+	}
+	return cpuPercent[0], nil
+}
 
-	var tempData TemperatureData
-	err = json.Unmarshal(output, &tempData)
+func getCPUInfo() (cpu.InfoStat, error) {
+	cpuInfo, err := cpu.Info()
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse temperature data: %v", err)
+		return cpu.InfoStat{}, err
 	}
+	if len(cpuInfo) == 0 {
+		return cpu.InfoStat{}, fmt.Errorf("cpu info not available")
+	}
+	return cpuInfo[0], nil
+}
 
-	if tempData.Temperature == 0 {
-		return 0, fmt.Errorf("temperature data not available")
+func getMemoryUsage() (float64, error) {
+	memInfo, err := mem.VirtualMemory()
+	if err != nil {
+		return 0, err
 	}
+	return memInfo.UsedPercent, nil
+}
 
-	return tempData.Temperature, nil
+func getDiskUsage() (float64, error) {
+	diskInfo, err := disk.Usage(diskUsagePath)
+	if err != nil {
+		return 0, err
+	}
+	return diskInfo.UsedPercent, nil
 }
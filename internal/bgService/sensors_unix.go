@@ -0,0 +1,35 @@
+//go:build !windows
+
+package bgService
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/shirou/gopsutil/v4/sensors"
+)
+
+// diskUsagePath is the volume reported by the disk_usage sensor.
+const diskUsagePath = "/"
+
+// cpuSensorKeys are the hwmon/thermal zone names that report the CPU package
+// temperature on common Intel, AMD and ARM boards, in order of preference.
+var cpuSensorKeys = []string{"coretemp", "k10temp", "zenpower", "cpu_thermal", "cpu-thermal", "x86_pkg_temp", "acpitz"}
+
+func getCPUTemperature() (float64, error) {
+	temps, err := sensors.TemperaturesWithContext(context.Background())
+	if err != nil && len(temps) == 0 {
+		return 0, fmt.Errorf("failed to read temperature sensors: %v", err)
+	}
+
+	for _, key := range cpuSensorKeys {
+		for _, temp := range temps {
+			if strings.HasPrefix(temp.SensorKey, key) && temp.Temperature > 0 {
+				return temp.Temperature, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("temperature data not available")
+}
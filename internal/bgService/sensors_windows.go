@@ -0,0 +1,39 @@
+package bgService
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+// diskUsagePath is the volume reported by the disk_usage sensor.
+const diskUsagePath = "C:"
+
+func getCPUTemperature() (float64, error) {
+	cmd := exec.Command("powershell", "-Command", `
+		$temp = Get-WmiObject MSAcpi_ThermalZoneTemperature -Namespace "root/wmi" | Select-Object -First 1
+		if ($temp) {
+			$celsius = ($temp.CurrentTemperature / 10) - 273.15
+			ConvertTo-Json @{ Temperature = [math]::Round($celsius, 2) }
+		} else {
+			ConvertTo-Json @{ Temperature = $null }
+		}
+	`)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute PowerShell command: %v", err)
+	}
+
+	var tempData TemperatureData
+	err = json.Unmarshal(output, &tempData)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse temperature data: %v", err)
+	}
+
+	if tempData.Temperature == 0 {
+		return 0, fmt.Errorf("temperature data not available")
+	}
+
+	return tempData.Temperature, nil
+}
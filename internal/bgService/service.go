@@ -1,13 +1,16 @@
 package bgService
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime/debug"
 	"sync"
-	"syscall"
 	"time"
 
 	"win-sense-connect/internal/common"
@@ -16,7 +19,6 @@ import (
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gorilla/mux"
 	"github.com/kardianos/service"
-	"golang.org/x/sys/windows"
 )
 
 type program struct {
@@ -28,11 +30,32 @@ type program struct {
 	db            *shared.DB
 	eventChannels []chan []byte
 	eventMutex    sync.Mutex
+	sensors       *sensorScheduler
+	schedules     *commandScheduler
+	rules         *ruleEngine
+	executor      *scriptExecutor
+	metrics       *serviceMetrics
+	mqttState     mqttState
+	startedAt     time.Time
+	stop          chan struct{}
+	httpOnce      sync.Once
+	httpServer    *http.Server
+	httpMutex     sync.Mutex
+	// reloadMutex serializes config reloads, restarts and the setup in run, so
+	// they never apply half of a config
+	reloadMutex sync.Mutex
+	// configMutex guards config and mqttClient, which MQTT handlers, schedulers
+	// and HTTP handlers read while a reload replaces them. Read them through
+	// currentConfig and currentMQTTClient.
+	configMutex sync.RWMutex
+	// setupToken allows creating the first account remotely, see initSetupToken
+	setupToken string
 }
 
 func NewProgram() (*program, error) {
 	p := &program{
 		eventChannels: make([]chan []byte, 0),
+		startedAt:     time.Now(),
 	}
 	var err error
 
@@ -55,10 +78,12 @@ func NewProgram() (*program, error) {
 	}
 
 	// Initialize final logger with loaded config
-	p.Logger, err = NewLogger("WinSenseConnect.log", &p.config, "WinSenseConnect", p.broadcastEvent)
+	p.Logger, err = NewLogger("WinSenseConnect.log", p.currentConfig, "WinSenseConnect", p.broadcastEvent)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create logger: %v", err)
 	}
+	// Only one handle may stay open on the log file, or it can't be rotated
+	tempLogger.Close()
 
 	// Init Schema
 	err = p.db.InitSchema(p.Logger)
@@ -67,6 +92,18 @@ func NewProgram() (*program, error) {
 		return nil, err
 	}
 
+	if err := p.encryptStoredSecrets(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to encrypt stored secrets: %v", err))
+	}
+
+	if err := p.initSetupToken(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to create the setup token: %v", err))
+	}
+
+	if err := p.db.MarkInterruptedScriptRuns(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to mark interrupted script runs: %v", err))
+	}
+
 	exePath, err := os.Executable()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get executable path: %v", err)
@@ -78,6 +115,9 @@ func NewProgram() (*program, error) {
 	// Init Router
 	p.router = mux.NewRouter()
 
+	p.executor = newScriptExecutor(func() int { return p.currentConfig().MaxConcurrent })
+	p.metrics = newServiceMetrics(p)
+
 	return p, nil
 }
 
@@ -95,10 +135,13 @@ func (p *program) broadcastEvent(event []byte) {
 }
 
 func (p *program) Start(s service.Service) error {
-	p.Logger.Debug("Starting service")
+	p.Logger.Info("Starting service", "version", Version)
 	p.Logger.Debug("Config loaded, about to start run function")
-	go p.startHTTPServer()
-	go p.run()
+	p.httpOnce.Do(func() {
+		go p.startHTTPServer()
+	})
+	p.stop = make(chan struct{})
+	go p.run(p.stop)
 
 	// Start systray if it's not running
 	if err := p.startSystrayIfNotRunning(); err != nil {
@@ -108,7 +151,7 @@ func (p *program) Start(s service.Service) error {
 	return nil
 }
 
-func (p *program) run() {
+func (p *program) run(stop chan struct{}) {
 	defer func() {
 		if r := recover(); r != nil {
 			p.Logger.Error(fmt.Sprintf("Recovered from panic in run: %v\nStack trace: %s", r, debug.Stack()))
@@ -117,106 +160,185 @@ func (p *program) run() {
 
 	p.Logger.Debug("Run function started")
 
-	p.setupMQTTClient()
-
-	for {
-		p.Logger.Debug(fmt.Sprintf("Attempting to connect to MQTT broker at %s...", p.config.BrokerAddress))
-		if token := p.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-			p.Logger.Error(fmt.Sprintf("Connection failed: %v", token.Error()))
-			time.Sleep(time.Second * 10)
-		} else {
-			p.Logger.Debug("Connection successful")
-			break
-		}
+	if err := p.setup(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to set up MQTT client: %v", err))
+		return
 	}
 
 	for {
-		if !p.mqttClient.IsConnected() {
-			p.Logger.Debug("Connection lost, attempting to reconnect...")
-			if token := p.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-				p.Logger.Error(fmt.Sprintf("Reconnection failed: %v", token.Error()))
+		// Re-read the client every iteration, a config reload may have replaced it
+		client := p.currentMQTTClient()
+		interval := time.Minute
+		if !client.IsConnected() {
+			p.Logger.Debug(fmt.Sprintf("Attempting to connect to MQTT broker at %s...", p.currentConfig().BrokerAddress))
+			if token := client.Connect(); token.Wait() && token.Error() != nil {
+				p.Logger.Error(fmt.Sprintf("Connection failed: %v", token.Error()))
+				p.mqttState.failed(token.Error())
+				interval = time.Second * 10
 			} else {
-				p.Logger.Debug("Reconnection successful")
+				p.Logger.Debug("Connection successful")
 			}
 		} else {
 			p.Logger.Debug("MQTT client is connected")
 		}
-		time.Sleep(time.Minute)
+
+		select {
+		case <-stop:
+			p.Logger.Debug("Run function stopped")
+			return
+		case <-time.After(interval):
+		}
 		p.Logger.Debug("Service is still running...")
 	}
 }
 
-func (p *program) Stop(s service.Service) error {
-	p.Logger.Debug("Stopping service")
-	if p.mqttClient != nil && p.mqttClient.IsConnected() {
-		p.mqttClient.Disconnect(250)
+// setup creates the MQTT client and starts the sensors, schedules and rules. It
+// holds reloadMutex, so a reload can't find some of them set up and others not.
+func (p *program) setup() error {
+	p.reloadMutex.Lock()
+	defer p.reloadMutex.Unlock()
+
+	if err := p.setupMQTTClient(); err != nil {
+		return err
 	}
-	return nil
-}
 
-func (p *program) runAsLoggedInUser(scriptPath string) (string, error) {
-	sessionID, err := getActiveSessionID()
-	if err != nil {
-		p.Logger.Error(fmt.Sprintf("failed to get active session ID: %v", err))
-		return "", fmt.Errorf("failed to get active session ID: %v", err)
+	p.sensors = newSensorScheduler(p)
+	if err := p.loadSensors(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to start sensors: %v", err))
 	}
 
-	var userToken windows.Token
-	err = wtsQueryUserToken(sessionID, &userToken)
-	if err != nil {
-		p.Logger.Error(fmt.Sprintf("failed to get user token: %v", err))
-		return "", fmt.Errorf("failed to get user token: %v", err)
+	p.schedules = newCommandScheduler(p)
+	if err := p.loadSchedules(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to start schedules: %v", err))
 	}
-	defer userToken.Close()
 
-	cmd := exec.Command("powershell", "-ExecutionPolicy", "Bypass", "-Command",
-		fmt.Sprintf("Set-ExecutionPolicy -ExecutionPolicy Unrestricted -Scope Process; & '%s'", scriptPath))
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Token:         syscall.Token(userToken),
-		CreationFlags: windows.CREATE_NO_WINDOW,
+	p.rules = newRuleEngine(p)
+	if err := p.loadRules(); err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to start sensor rules: %v", err))
 	}
+	return nil
+}
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		p.Logger.Error(fmt.Sprintf("command failed: %v\nOutput: %s", err, output))
-		return "", fmt.Errorf("command failed: %v\nOutput: %s", err, output)
+func (p *program) Stop(s service.Service) error {
+	p.reloadMutex.Lock()
+	defer p.reloadMutex.Unlock()
+	return p.shutdown()
+}
+
+// shutdown stops everything Start started except the HTTP server. The caller
+// holds reloadMutex.
+func (p *program) shutdown() error {
+	p.Logger.Info("Stopping service")
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	if p.sensors != nil {
+		p.sensors.Stop()
+	}
+	if p.schedules != nil {
+		p.schedules.Stop()
+	}
+	if p.rules != nil {
+		p.rules.Stop()
+	}
+	if client := p.currentMQTTClient(); client != nil {
+		p.disconnectMQTT(client)
 	}
+	return nil
+}
+
+// errScriptTimeout is returned when a script exceeds its configured timeout and
+// its process tree has been killed.
+var errScriptTimeout = errors.New("script timed out")
+
+type scriptResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
 
-	return string(output), nil
+// scriptTimeout returns the per-script timeout, falling back to the global one.
+// A zero duration means the script may run indefinitely.
+func (p *program) scriptTimeout(scriptConfig ScriptConfig) time.Duration {
+	if scriptConfig.ScriptTimeout > 0 {
+		return time.Duration(scriptConfig.ScriptTimeout) * time.Second
+	}
+	if timeout := p.currentConfig().ScriptTimeout; timeout > 0 {
+		return time.Duration(timeout) * time.Second
+	}
+	return 0
 }
 
-func (p *program) runAsLocalSystem(scriptPath string) (string, error) {
-	cmd := exec.Command("powershell", "-ExecutionPolicy", "Bypass", "-File", scriptPath)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		CreationFlags: windows.CREATE_NO_WINDOW,
+// runCommand runs cmd until it exits or ctx expires. On expiry the whole
+// process tree is killed, since scripts commonly spawn children that would
+// otherwise keep running and hold the output pipes open.
+func (p *program) runCommand(ctx context.Context, cmd *exec.Cmd) (scriptResult, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Cancel = func() error {
+		return killProcessTree(cmd.Process)
+	}
+	cmd.WaitDelay = time.Second * 5
+
+	err := cmd.Run()
+	result := scriptResult{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: -1,
+	}
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		p.Logger.Error(fmt.Sprintf("command timed out, killed process tree\nOutput: %s%s", result.Stdout, result.Stderr))
+		return result, errScriptTimeout
+	}
+	if ctx.Err() == context.Canceled {
+		p.Logger.Debug(fmt.Sprintf("command cancelled, killed process tree\nOutput: %s%s", result.Stdout, result.Stderr))
+		return result, errRunCancelled
 	}
-	output, err := cmd.CombinedOutput()
 	if err != nil {
-		p.Logger.Error(fmt.Sprintf("command failed: %v\nOutput: %s", err, output))
-		return "", fmt.Errorf("command failed: %v\nOutput: %s", err, output)
+		p.Logger.Error(fmt.Sprintf("command failed: %v\nOutput: %s%s", err, result.Stdout, result.Stderr))
+		return result, fmt.Errorf("command failed: %v\nOutput: %s%s", err, result.Stdout, result.Stderr)
 	}
 
-	return string(output), nil
+	return result, nil
 }
 
-func (p *program) executeScript(scriptPath string, runAsUser bool) (string, error) {
-	if runAsUser {
-		return p.runAsLoggedInUser(scriptPath)
+func (p *program) executeScript(ctx context.Context, scriptPath string, scriptConfig ScriptConfig, timeout time.Duration, args scriptArgs) (scriptResult, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	name, cmdArgs := scriptCommand(scriptPath, scriptConfig, args)
+	if scriptConfig.RunAsUser {
+		return p.runAsLoggedInUser(ctx, name, cmdArgs, args)
 	} else {
-		return p.runAsLocalSystem(scriptPath)
+		return p.runAsLocalSystem(ctx, name, cmdArgs, args)
 	}
 }
 
 func (p *program) restartService() error {
+	// Hold off reloads until the service runs again, a reload in between would
+	// restart what was just stopped
+	p.reloadMutex.Lock()
+	defer p.reloadMutex.Unlock()
+
 	p.Logger.Debug("Restarting service")
-	err := p.Stop(nil)
+	err := p.shutdown()
 	if err != nil {
 		p.Logger.Error(fmt.Sprintf("failed to stop service: %v", err))
 		return fmt.Errorf("failed to stop service: %v", err)
 	}
-	// clear mqtt client
-	p.mqttClient = nil
 	time.Sleep(time.Second * 5)
+	if err := p.loadConfig(p.Logger); err != nil {
+		return fmt.Errorf("failed to reload config: %v", err)
+	}
 	p.Logger.Debug("Service stopped, restarting...")
 	err = p.Start(nil)
 	if err != nil {
@@ -225,36 +347,3 @@ func (p *program) restartService() error {
 	}
 	return nil
 }
-
-func (p *program) isSystrayRunning() bool {
-	cmd := exec.Command("tasklist", "/FI", "IMAGENAME eq WinSenseConnectSystray.exe", "/FO", "CSV", "/NH")
-	output, err := cmd.Output()
-	if err != nil {
-		p.Logger.Error(fmt.Sprintf("Failed to check if systray is running: %v", err))
-		return false
-	}
-	return len(output) > 0
-}
-
-func (p *program) startSystrayIfNotRunning() error {
-	if !p.isSystrayRunning() {
-		p.Logger.Debug("Systray is not running. Starting it now.")
-		exePath, err := os.Executable()
-		if err != nil {
-			return fmt.Errorf("failed to get executable path: %v", err)
-		}
-		systrayPath := filepath.Join(filepath.Dir(exePath), "WinSenseConnectSystray.exe")
-		cmd := exec.Command(systrayPath)
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			CreationFlags: windows.CREATE_NO_WINDOW,
-		}
-		err = cmd.Start()
-		if err != nil {
-			return fmt.Errorf("failed to start systray: %v", err)
-		}
-		p.Logger.Debug("Systray started successfully.")
-	} else {
-		p.Logger.Debug("Systray is already running.")
-	}
-	return nil
-}
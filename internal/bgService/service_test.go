@@ -0,0 +1,36 @@
+package bgService
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScriptTimeout(t *testing.T) {
+	tests := []struct {
+		name          string
+		global        int
+		script        int
+		scriptTimeout time.Duration
+	}{
+		{name: "script timeout wins", global: 300, script: 30, scriptTimeout: 30 * time.Second},
+		{name: "falls back to the global timeout", global: 300, script: 0, scriptTimeout: 300 * time.Second},
+		{name: "no timeout", global: 0, script: 0, scriptTimeout: 0},
+		{name: "negative values mean no timeout", global: -1, script: -1, scriptTimeout: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &program{}
+			p.config.ScriptTimeout = tt.global
+			if timeout := p.scriptTimeout(ScriptConfig{ScriptTimeout: tt.script}); timeout != tt.scriptTimeout {
+				t.Errorf("timeout = %s, want %s", timeout, tt.scriptTimeout)
+			}
+		})
+	}
+}
+
+func TestKillProcessTreeWithoutProcess(t *testing.T) {
+	// A command that failed to start has no process to kill
+	if err := killProcessTree(nil); err != nil {
+		t.Errorf("killProcessTree(nil) = %v, want nil", err)
+	}
+}
@@ -0,0 +1,62 @@
+//go:build !windows
+
+package bgService
+
+import (
+	"fmt"
+	"log/syslog"
+	"os"
+)
+
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+// openSystemLog connects to the local syslog daemon. Containers and minimal
+// installs often have none, so fall back to stderr, which systemd forwards to
+// the journal as well.
+func openSystemLog(serviceName string) (systemLog, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, serviceName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "syslog not available, logging to stderr: %v\n", err)
+		return stderrLog{}, nil
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+func (s *syslogWriter) Info(eid uint32, msg string) error {
+	return s.w.Info(msg)
+}
+
+func (s *syslogWriter) Warning(eid uint32, msg string) error {
+	return s.w.Warning(msg)
+}
+
+func (s *syslogWriter) Error(eid uint32, msg string) error {
+	return s.w.Err(msg)
+}
+
+func (s *syslogWriter) Close() error {
+	return s.w.Close()
+}
+
+type stderrLog struct{}
+
+func (stderrLog) Info(eid uint32, msg string) error {
+	_, err := fmt.Fprintln(os.Stderr, msg)
+	return err
+}
+
+func (stderrLog) Warning(eid uint32, msg string) error {
+	_, err := fmt.Fprintln(os.Stderr, "WARNING: "+msg)
+	return err
+}
+
+func (stderrLog) Error(eid uint32, msg string) error {
+	_, err := fmt.Fprintln(os.Stderr, "ERROR: "+msg)
+	return err
+}
+
+func (stderrLog) Close() error {
+	return nil
+}
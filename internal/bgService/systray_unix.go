@@ -0,0 +1,9 @@
+//go:build !windows
+
+package bgService
+
+// startSystrayIfNotRunning is a no-op outside of Windows. The agent usually runs
+// on headless hosts there, and the dashboard is reachable over HTTP.
+func (p *program) startSystrayIfNotRunning() error {
+	return nil
+}
@@ -0,0 +1,44 @@
+package bgService
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+func (p *program) isSystrayRunning() bool {
+	cmd := exec.Command("tasklist", "/FI", "IMAGENAME eq WinSenseConnectSystray.exe", "/FO", "CSV", "/NH")
+	output, err := cmd.Output()
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to check if systray is running: %v", err))
+		return false
+	}
+	return len(output) > 0
+}
+
+func (p *program) startSystrayIfNotRunning() error {
+	if !p.isSystrayRunning() {
+		p.Logger.Debug("Systray is not running. Starting it now.")
+		exePath, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to get executable path: %v", err)
+		}
+		systrayPath := filepath.Join(filepath.Dir(exePath), "WinSenseConnectSystray.exe")
+		cmd := exec.Command(systrayPath)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			CreationFlags: windows.CREATE_NO_WINDOW,
+		}
+		err = cmd.Start()
+		if err != nil {
+			return fmt.Errorf("failed to start systray: %v", err)
+		}
+		p.Logger.Debug("Systray started successfully.")
+	} else {
+		p.Logger.Debug("Systray is already running.")
+	}
+	return nil
+}
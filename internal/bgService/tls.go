@@ -0,0 +1,186 @@
+package bgService
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Where the generated self-signed dashboard certificate is kept, relative to
+// the executable
+const (
+	selfSignedCertFile = "data/https-cert.pem"
+	selfSignedKeyFile  = "data/https-key.pem"
+)
+
+// selfSignedValidity is how long a generated certificate is valid. An expired
+// one is replaced on the next start.
+const selfSignedValidity = 2 * 365 * 24 * time.Hour
+
+// newBrokerTLSConfig builds the TLS settings for the broker connection from the
+// tls_* config fields. It returns nil when none of them are set, which leaves
+// paho's defaults in place for plain tcp:// and default ssl:// brokers.
+func newBrokerTLSConfig(config Config) (*tls.Config, error) {
+	if config.TLSCAFile == "" && config.TLSCertFile == "" && config.TLSKeyFile == "" &&
+		config.TLSServerName == "" && !config.TLSInsecure {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.TLSServerName,
+		InsecureSkipVerify: config.TLSInsecure,
+	}
+
+	if config.TLSCAFile != "" {
+		caPEM, err := os.ReadFile(resolveConfigPath(config.TLSCAFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", config.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+			return nil, fmt.Errorf("both a client certificate and key are required for mutual TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(resolveConfigPath(config.TLSCertFile), resolveConfigPath(config.TLSKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// resolveConfigPath resolves paths from the config relative to the directory of
+// the executable, the same place the scripts and data folders live.
+func resolveConfigPath(path string) string {
+	path = strings.TrimSpace(path)
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	exePath, err := os.Executable()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(filepath.Dir(exePath), path)
+}
+
+// newHTTPTLSConfig builds the TLS settings for the dashboard and API. It
+// returns nil when HTTPS isn't enabled. A configured certificate takes
+// precedence over a self-signed one.
+func newHTTPTLSConfig(config Config) (*tls.Config, error) {
+	if (config.HTTPTLSCertFile == "") != (config.HTTPTLSKeyFile == "") {
+		return nil, fmt.Errorf("both a certificate and key are required for HTTPS")
+	}
+	if !config.HTTPSEnabled() {
+		return nil, nil
+	}
+
+	var cert tls.Certificate
+	var err error
+	if config.HTTPTLSCertFile != "" {
+		cert, err = tls.LoadX509KeyPair(resolveConfigPath(config.HTTPTLSCertFile), resolveConfigPath(config.HTTPTLSKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load HTTPS certificate: %v", err)
+		}
+	} else {
+		cert, err = selfSignedCertificate(config, resolveConfigPath(selfSignedCertFile), resolveConfigPath(selfSignedKeyFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// selfSignedCertificate loads the generated dashboard certificate from
+// certPath and keyPath, or creates a new one when it doesn't exist yet or has
+// expired.
+func selfSignedCertificate(config Config, certPath, keyPath string) (tls.Certificate, error) {
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Now().Before(leaf.NotAfter) {
+			return cert, nil
+		}
+	}
+
+	certPEM, keyPEM, err := generateSelfSignedCertificate(config)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate directory: %v", err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to write self-signed certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to write self-signed key: %v", err)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// generateSelfSignedCertificate creates a certificate for the PC's host name,
+// localhost and the listen address.
+func generateSelfSignedCertificate(config Config) (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"WinSenseConnect"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if ip := net.ParseIP(config.HTTPListenAddress); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal key: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,314 @@
+package bgService
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate valid until notAfter and its
+// key to dir and returns their paths.
+func writeTestCert(t *testing.T, dir, name string, notAfter time.Time) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notAfter.Add(-24 * time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		DNSNames:              []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+"-cert.pem")
+	keyFile = filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestNewBrokerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	caFile, _ := writeTestCert(t, dir, "ca", time.Now().Add(time.Hour))
+	certFile, keyFile := writeTestCert(t, dir, "client", time.Now().Add(time.Hour))
+	notPEM := filepath.Join(dir, "not-pem.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		// none is true when paho's defaults should be kept
+		none  bool
+		err   bool
+		check func(t *testing.T, tlsConfig *tls.Config)
+	}{
+		{name: "no TLS settings", none: true},
+		{
+			name:   "server name and insecure",
+			config: Config{TLSServerName: "broker.local", TLSInsecure: true},
+			check: func(t *testing.T, tlsConfig *tls.Config) {
+				if tlsConfig.ServerName != "broker.local" || !tlsConfig.InsecureSkipVerify {
+					t.Errorf("server name %q, insecure %v", tlsConfig.ServerName, tlsConfig.InsecureSkipVerify)
+				}
+			},
+		},
+		{
+			name:   "CA bundle",
+			config: Config{TLSCAFile: caFile},
+			check: func(t *testing.T, tlsConfig *tls.Config) {
+				if tlsConfig.RootCAs == nil || tlsConfig.InsecureSkipVerify {
+					t.Error("CA bundle wasn't used to verify the broker")
+				}
+			},
+		},
+		{
+			name:   "mutual TLS",
+			config: Config{TLSCertFile: certFile, TLSKeyFile: keyFile},
+			check: func(t *testing.T, tlsConfig *tls.Config) {
+				if len(tlsConfig.Certificates) != 1 {
+					t.Errorf("got %d client certificates, want 1", len(tlsConfig.Certificates))
+				}
+			},
+		},
+		{name: "missing CA bundle", config: Config{TLSCAFile: filepath.Join(dir, "missing.pem")}, err: true},
+		{name: "CA bundle without certificates", config: Config{TLSCAFile: notPEM}, err: true},
+		{name: "certificate without key", config: Config{TLSCertFile: certFile}, err: true},
+		{name: "key without certificate", config: Config{TLSKeyFile: keyFile}, err: true},
+		{name: "key of another certificate", config: Config{TLSCertFile: certFile, TLSKeyFile: caFile}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := newBrokerTLSConfig(tt.config)
+			if tt.err {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.none {
+				if tlsConfig != nil {
+					t.Errorf("config = %+v, want nil", tlsConfig)
+				}
+				return
+			}
+			if tlsConfig == nil {
+				t.Fatal("config is nil")
+			}
+			if tlsConfig.MinVersion != tls.VersionTLS12 {
+				t.Errorf("min version = %x, want TLS 1.2", tlsConfig.MinVersion)
+			}
+			tt.check(t, tlsConfig)
+		})
+	}
+}
+
+func TestNewHTTPTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "dashboard", time.Now().Add(time.Hour))
+	tests := []struct {
+		name   string
+		config Config
+		none   bool
+		err    bool
+	}{
+		{name: "HTTPS disabled", none: true},
+		{name: "certificate", config: Config{HTTPTLSCertFile: certFile, HTTPTLSKeyFile: keyFile}},
+		{name: "certificate without key", config: Config{HTTPTLSCertFile: certFile}, err: true},
+		{name: "key without certificate", config: Config{HTTPTLSKeyFile: keyFile}, err: true},
+		{name: "key without certificate and self-signed", config: Config{HTTPTLSKeyFile: keyFile, HTTPSelfSigned: true}, err: true},
+		{name: "missing key file", config: Config{HTTPTLSCertFile: certFile, HTTPTLSKeyFile: filepath.Join(dir, "missing.pem")}, err: true},
+		{name: "missing certificate file", config: Config{HTTPTLSCertFile: filepath.Join(dir, "missing.pem"), HTTPTLSKeyFile: keyFile}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := newHTTPTLSConfig(tt.config)
+			if tt.err {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.none {
+				if tlsConfig != nil {
+					t.Errorf("config = %+v, want nil", tlsConfig)
+				}
+				return
+			}
+			if tlsConfig == nil || len(tlsConfig.Certificates) != 1 || tlsConfig.MinVersion != tls.VersionTLS12 {
+				t.Errorf("config = %+v, want the certificate with TLS 1.2 or newer", tlsConfig)
+			}
+		})
+	}
+}
+
+// parseTestCert returns the leaf of a certificate returned by
+// selfSignedCertificate.
+func parseTestCert(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func TestSelfSignedCertificateNames(t *testing.T) {
+	hostname, _ := os.Hostname()
+	tests := []struct {
+		listenAddress string
+		extraIP       net.IP
+	}{
+		{listenAddress: ""},
+		{listenAddress: "0.0.0.0"},
+		{listenAddress: "127.0.0.1"},
+		{listenAddress: "192.168.1.20", extraIP: net.ParseIP("192.168.1.20")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.listenAddress, func(t *testing.T) {
+			dir := t.TempDir()
+			cert, err := selfSignedCertificate(Config{HTTPListenAddress: tt.listenAddress}, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf := parseTestCert(t, cert)
+
+			names := []string{"localhost", "127.0.0.1", "::1"}
+			if hostname != "" {
+				names = append(names, hostname)
+			}
+			if tt.extraIP != nil {
+				names = append(names, tt.extraIP.String())
+			}
+			for _, name := range names {
+				if err := leaf.VerifyHostname(name); err != nil {
+					t.Errorf("certificate isn't valid for %s: %v", name, err)
+				}
+			}
+			wantIPs := 2
+			if tt.extraIP != nil {
+				wantIPs++
+			}
+			if len(leaf.IPAddresses) != wantIPs {
+				t.Errorf("IP addresses = %v, want %d", leaf.IPAddresses, wantIPs)
+			}
+			if time.Until(leaf.NotAfter) < selfSignedValidity-time.Hour {
+				t.Errorf("certificate expires at %s, want it valid for %s", leaf.NotAfter, selfSignedValidity)
+			}
+		})
+	}
+}
+
+func TestSelfSignedCertificateReuse(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	first, err := selfSignedCertificate(Config{}, certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, want 0600", info.Mode().Perm())
+	}
+	again, err := selfSignedCertificate(Config{}, certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parseTestCert(t, again).SerialNumber.Cmp(parseTestCert(t, first).SerialNumber) != 0 {
+		t.Error("a valid certificate was regenerated")
+	}
+
+	// An expired certificate is replaced with a new one
+	expiredCert, expiredKey := writeTestCert(t, dir, "expired", time.Now().Add(-time.Hour))
+	if err := os.Rename(expiredCert, certPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(expiredKey, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := selfSignedCertificate(Config{}, certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf := parseTestCert(t, renewed); !time.Now().Before(leaf.NotAfter) {
+		t.Errorf("expired certificate wasn't regenerated, it expires at %s", leaf.NotAfter)
+	}
+	stored, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parseTestCert(t, stored).SerialNumber.Cmp(parseTestCert(t, renewed).SerialNumber) != 0 {
+		t.Error("the regenerated certificate wasn't saved")
+	}
+
+	// A key that doesn't belong to the certificate is replaced as well
+	if err := os.WriteFile(keyPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := selfSignedCertificate(Config{}, certPath, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		t.Errorf("stored pair is still invalid: %v", err)
+	}
+}
+
+func TestLoopbackHTTPAddress(t *testing.T) {
+	tests := []struct {
+		config Config
+		want   string
+	}{
+		{config: Config{HTTPListenAddress: "", HTTPPort: 8077}, want: "127.0.0.1:8077"},
+		{config: Config{HTTPListenAddress: "0.0.0.0", HTTPPort: 9000}, want: "127.0.0.1:9000"},
+		{config: Config{HTTPListenAddress: "192.168.1.20", HTTPPort: 8077}, want: "127.0.0.1:8077"},
+		{config: Config{HTTPListenAddress: "127.0.0.1", HTTPPort: 8077}, want: "127.0.0.1:8077"},
+		{config: Config{HTTPListenAddress: "::1", HTTPPort: 8077}, want: "[::1]:8077"},
+		{config: Config{HTTPListenAddress: "localhost", HTTPPort: 8077}, want: "localhost:8077"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.config.HTTPListenAddress, func(t *testing.T) {
+			if got := loopbackHTTPAddress(tt.config); got != tt.want {
+				t.Errorf("address = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -22,15 +22,14 @@ type WTS_SESSION_INFO struct {
 
 func getActiveSessionID() (uint32, error) {
 	var count uint32
-	var sessions uintptr
+	var sessions *WTS_SESSION_INFO
 	ret, _, err := procWTSEnumerateSessions.Call(0, 0, 1, uintptr(unsafe.Pointer(&sessions)), uintptr(unsafe.Pointer(&count)))
 	if ret == 0 {
 		return 0, fmt.Errorf("WTSEnumerateSessions failed: %v", err)
 	}
-	defer procWTSFreeMemory.Call(sessions)
+	defer procWTSFreeMemory.Call(uintptr(unsafe.Pointer(sessions)))
 
-	for i := uint32(0); i < count; i++ {
-		session := *(*WTS_SESSION_INFO)(unsafe.Pointer(sessions + uintptr(i)*unsafe.Sizeof(WTS_SESSION_INFO{})))
+	for _, session := range unsafe.Slice(sessions, count) {
 		if session.State == 0 { // WTSActive
 			return session.SessionID, nil
 		}
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"net"
+	"strconv"
+)
+
+// DefaultHTTPPort is the port of the dashboard and API when none is configured.
+const DefaultHTTPPort = 8077
+
+func (c Config) httpPort() string {
+	if c.HTTPPort <= 0 {
+		return strconv.Itoa(DefaultHTTPPort)
+	}
+	return strconv.Itoa(c.HTTPPort)
+}
+
+// HTTPAddress returns the address the dashboard and API listen on. An empty
+// listen address listens on every interface.
+func (c Config) HTTPAddress() string {
+	return net.JoinHostPort(c.HTTPListenAddress, c.httpPort())
+}
+
+// HTTPSEnabled reports whether the dashboard and API are served over HTTPS.
+func (c Config) HTTPSEnabled() bool {
+	return c.HTTPSelfSigned || c.HTTPTLSCertFile != ""
+}
+
+// DashboardURL returns the URL to open the dashboard at from this PC.
+func (c Config) DashboardURL() string {
+	scheme := "http"
+	if c.HTTPSEnabled() {
+		scheme = "https"
+	}
+	host := c.HTTPListenAddress
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, c.httpPort())
+}
@@ -0,0 +1,30 @@
+package common
+
+import "unicode/utf8"
+
+// Script run values the systray needs as well as the service, which records
+// the hotkey runs it executes itself.
+const (
+	RunSourceHotkey = "hotkey"
+
+	RunStatusRunning = "running"
+	RunStatusSuccess = "success"
+	RunStatusFailed  = "failed"
+)
+
+// MaxRunOutput caps how much stdout/stderr is kept per run in script_runs.
+const MaxRunOutput = 64 * 1024
+
+// TruncateRunOutput shortens output to MaxRunOutput bytes. It cuts before a
+// character that doesn't fit rather than through it, so the stored output
+// stays valid UTF-8.
+func TruncateRunOutput(output string) string {
+	if len(output) <= MaxRunOutput {
+		return output
+	}
+	cut := MaxRunOutput
+	for cut > 0 && !utf8.RuneStart(output[cut]) {
+		cut--
+	}
+	return output[:cut] + "\n... (truncated)"
+}
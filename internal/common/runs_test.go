@@ -0,0 +1,43 @@
+package common
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateRunOutput(t *testing.T) {
+	const suffix = "\n... (truncated)"
+	tail := func(s string) string {
+		if len(s) > 20 {
+			return s[len(s)-20:]
+		}
+		return s
+	}
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{name: "short", output: "done", want: "done"},
+		{name: "exactly the limit", output: strings.Repeat("a", MaxRunOutput), want: strings.Repeat("a", MaxRunOutput)},
+		{name: "ASCII", output: strings.Repeat("a", MaxRunOutput+1), want: strings.Repeat("a", MaxRunOutput) + suffix},
+		// "é" is two bytes, "€" three and "😀" four; each straddles the limit
+		{name: "two-byte character", output: strings.Repeat("a", MaxRunOutput-1) + "é", want: strings.Repeat("a", MaxRunOutput-1) + suffix},
+		{name: "three-byte character", output: strings.Repeat("a", MaxRunOutput-2) + "€b", want: strings.Repeat("a", MaxRunOutput-2) + suffix},
+		{name: "four-byte character", output: strings.Repeat("a", MaxRunOutput-1) + "😀", want: strings.Repeat("a", MaxRunOutput-1) + suffix},
+		{name: "character ending at the limit", output: strings.Repeat("a", MaxRunOutput-3) + "€b", want: strings.Repeat("a", MaxRunOutput-3) + "€" + suffix},
+		{name: "only multi-byte characters", output: strings.Repeat("€", MaxRunOutput), want: strings.Repeat("€", MaxRunOutput/3) + suffix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TruncateRunOutput(tt.output)
+			if got != tt.want {
+				t.Errorf("got %d bytes ending in %q, want %d bytes ending in %q", len(got), tail(got), len(tt.want), tail(tt.want))
+			}
+			if !utf8.ValidString(got) {
+				t.Error("output isn't valid UTF-8")
+			}
+		})
+	}
+}
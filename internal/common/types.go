@@ -2,9 +2,13 @@ package common
 
 import "time"
 
+// Logger logs messages at four levels. fields are alternating keys and values,
+// like log/slog, e.g. Info("Command executed", "command", name, "run_id", id).
 type Logger interface {
-	Debug(message string)
-	Error(message string)
+	Debug(message string, fields ...any)
+	Info(message string, fields ...any)
+	Warn(message string, fields ...any)
+	Error(message string, fields ...any)
 	Close()
 }
 
@@ -17,32 +21,77 @@ type Config struct {
 	Topic               string                  `json:"topic"`
 	LogLevel            string                  `json:"log_level"`
 	ScriptTimeout       int                     `json:"script_timeout"`
+	LegacyResponses     bool                    `json:"legacy_responses"`
+	StatusTopic         string                  `json:"status_topic"`
+	PayloadOnline       string                  `json:"payload_online"`
+	PayloadOffline      string                  `json:"payload_offline"`
+	TLSCAFile           string                  `json:"tls_ca_file"`
+	TLSCertFile         string                  `json:"tls_cert_file"`
+	TLSKeyFile          string                  `json:"tls_key_file"`
+	TLSServerName       string                  `json:"tls_server_name"`
+	TLSInsecure         bool                    `json:"tls_insecure_skip_verify"`
+	MaxConcurrent       int                     `json:"max_concurrent_scripts"`
+	HTTPListenAddress   string                  `json:"http_listen_address"`
+	HTTPPort            int                     `json:"http_port"`
+	HTTPTLSCertFile     string                  `json:"http_tls_cert_file"`
+	HTTPTLSKeyFile      string                  `json:"http_tls_key_file"`
+	HTTPSelfSigned      bool                    `json:"http_tls_self_signed"`
+	CORSAllowedOrigins  string                  `json:"cors_allowed_origins"`
+	LogMaxSize          int                     `json:"log_max_size_mb"`
+	LogMaxAge           int                     `json:"log_max_age_hours"`
+	LogMaxFiles         int                     `json:"log_max_files"`
+	LogCompress         bool                    `json:"log_compress"`
+	LogFormat           string                  `json:"log_format"`
 	SensorConfigEnabled bool                    `json:"sensor_config_enabled"`
 	Commands            map[string]ScriptConfig `json:"commands"`
 	Sensors             map[string]SensorConfig `json:"sensors"`
 }
 
 type ConfigModel struct {
-	ID            int64     `db:"id"`
-	BrokerAddress string    `db:"broker_address"`
-	Username      string    `db:"username"`
-	Password      string    `db:"password"`
-	ClientID      string    `db:"client_id"`
-	Topic         string    `db:"topic"`
-	LogLevel      string    `db:"log_level"`
-	ScriptTimeout int       `db:"script_timeout"`
-	CreatedAt     time.Time `db:"created_at"`
-	UpdatedAt     time.Time `db:"updated_at"`
+	ID                 int64     `db:"id"`
+	BrokerAddress      string    `db:"broker_address"`
+	Username           string    `db:"username"`
+	Password           string    `db:"password"`
+	ClientID           string    `db:"client_id"`
+	Topic              string    `db:"topic"`
+	LogLevel           string    `db:"log_level"`
+	ScriptTimeout      int       `db:"script_timeout"`
+	LegacyResponses    bool      `db:"legacy_responses"`
+	StatusTopic        string    `db:"status_topic"`
+	PayloadOnline      string    `db:"payload_online"`
+	PayloadOffline     string    `db:"payload_offline"`
+	TLSCAFile          string    `db:"tls_ca_file"`
+	TLSCertFile        string    `db:"tls_cert_file"`
+	TLSKeyFile         string    `db:"tls_key_file"`
+	TLSServerName      string    `db:"tls_server_name"`
+	TLSInsecure        bool      `db:"tls_insecure_skip_verify"`
+	MaxConcurrent      int       `db:"max_concurrent_scripts"`
+	HTTPListenAddress  string    `db:"http_listen_address"`
+	HTTPPort           int       `db:"http_port"`
+	HTTPTLSCertFile    string    `db:"http_tls_cert_file"`
+	HTTPTLSKeyFile     string    `db:"http_tls_key_file"`
+	HTTPSelfSigned     bool      `db:"http_tls_self_signed"`
+	CORSAllowedOrigins string    `db:"cors_allowed_origins"`
+	LogMaxSize         int       `db:"log_max_size_mb"`
+	LogMaxAge          int       `db:"log_max_age_hours"`
+	LogMaxFiles        int       `db:"log_max_files"`
+	LogCompress        bool      `db:"log_compress"`
+	LogFormat          string    `db:"log_format"`
+	CreatedAt          time.Time `db:"created_at"`
+	UpdatedAt          time.Time `db:"updated_at"`
 }
 
 type ScriptConfig struct {
-	ID            int64     `db:"id" json:"id"`
-	Name          string    `db:"name" json:"name"`
-	ScriptPath    string    `db:"script_path" json:"script_path"`
-	RunAsUser     bool      `db:"run_as_user" json:"run_as_user"`
-	ScriptTimeout int       `db:"script_timeout" json:"script_timeout"`
-	CreatedAt     time.Time `db:"created_at" json:"created_at"`
-	UpdatedAt     time.Time `db:"updated_at" json:"updated_at"`
+	ID              int64     `db:"id" json:"id"`
+	Name            string    `db:"name" json:"name"`
+	ScriptPath      string    `db:"script_path" json:"script_path"`
+	RunAsUser       bool      `db:"run_as_user" json:"run_as_user"`
+	ScriptTimeout   int       `db:"script_timeout" json:"script_timeout"`
+	Interpreter     string    `db:"interpreter" json:"interpreter"`
+	InterpreterArgs string    `db:"interpreter_args" json:"interpreter_args"`
+	Concurrency     string    `db:"concurrency" json:"concurrency"`
+	CreatedAt       time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt       time.Time `db:"updated_at" json:"updated_at"`
 }
 
 type ScriptConfigs []ScriptConfig
@@ -62,9 +111,94 @@ type SensorConfigs []SensorConfig
 // New structs for systray configuration
 type SystrayConfig struct {
 	HotkeyCommands []HotkeyCommand
+	DashboardURL   string
 }
 
 type HotkeyCommand struct {
 	Hotkey  string
 	Command string
 }
+
+type ScriptRun struct {
+	ID        int64     `db:"id" json:"id"`
+	Command   string    `db:"command" json:"command"`
+	Source    string    `db:"source" json:"source"`
+	RequestID string    `db:"request_id" json:"request_id,omitempty"`
+	Status    string    `db:"status" json:"status"`
+	ExitCode  int       `db:"exit_code" json:"exit_code"`
+	Stdout    string    `db:"stdout" json:"stdout"`
+	Stderr    string    `db:"stderr" json:"stderr"`
+	StartedAt time.Time `db:"started_at" json:"started_at"`
+	EndedAt   time.Time `db:"ended_at" json:"ended_at"`
+}
+
+type ScriptRuns []ScriptRun
+
+type ScriptRunFilter struct {
+	Command string
+	Status  string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+type Schedule struct {
+	ID              int64     `db:"id" json:"id"`
+	Name            string    `db:"name" json:"name"`
+	ScriptID        int64     `db:"script_id" json:"script_id"`
+	Cron            string    `db:"cron" json:"cron"`
+	Interval        int       `db:"interval" json:"interval"`
+	Timezone        string    `db:"timezone" json:"timezone"`
+	Jitter          int       `db:"jitter" json:"jitter"`
+	MissedRunPolicy string    `db:"missed_run_policy" json:"missed_run_policy"`
+	Enabled         bool      `db:"enabled" json:"enabled"`
+	LastRunAt       time.Time `db:"last_run_at" json:"last_run_at"`
+	CreatedAt       time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt       time.Time `db:"updated_at" json:"updated_at"`
+}
+
+type Schedules []Schedule
+
+type SensorRule struct {
+	ID         int64     `db:"id" json:"id"`
+	Name       string    `db:"name" json:"name"`
+	Sensor     string    `db:"sensor" json:"sensor"`
+	Operator   string    `db:"operator" json:"operator"`
+	Threshold  float64   `db:"threshold" json:"threshold"`
+	Duration   int       `db:"duration" json:"duration"`
+	Hysteresis float64   `db:"hysteresis" json:"hysteresis"`
+	Interval   int       `db:"interval" json:"interval"`
+	ScriptID   int64     `db:"script_id" json:"script_id"`
+	AlertTopic string    `db:"alert_topic" json:"alert_topic"`
+	Enabled    bool      `db:"enabled" json:"enabled"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt  time.Time `db:"updated_at" json:"updated_at"`
+}
+
+type SensorRules []SensorRule
+
+type User struct {
+	ID           int64     `db:"id" json:"id"`
+	Username     string    `db:"username" json:"username"`
+	PasswordHash string    `db:"password_hash" json:"-"`
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt    time.Time `db:"updated_at" json:"updated_at"`
+}
+
+type Session struct {
+	ID        int64     `db:"id" json:"id"`
+	TokenHash string    `db:"token_hash" json:"-"`
+	UserID    int64     `db:"user_id" json:"user_id"`
+	ExpiresAt time.Time `db:"expires_at" json:"expires_at"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+type APIToken struct {
+	ID         int64     `db:"id" json:"id"`
+	Name       string    `db:"name" json:"name"`
+	TokenHash  string    `db:"token_hash" json:"-"`
+	LastUsedAt time.Time `db:"last_used_at" json:"last_used_at"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+type APITokens []APIToken
@@ -32,64 +32,33 @@ func NewDB() (*DB, error) {
 		}
 	}
 
-	db, err := sql.Open("sqlite3", dbpath)
+	// Take the write lock when a transaction begins, so the service and the
+	// systray wait for each other instead of failing when both migrate
+	db, err := sql.Open("sqlite3", dbpath+"?_txlock=immediate")
 	if err != nil {
 		return nil, err
 	}
 	if err = db.Ping(); err != nil {
 		return nil, err
 	}
-	return &DB{db}, nil
+
+	d := &DB{db}
+	if err := d.Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
 }
 
+// InitSchema adds the default data to a new database. The tables themselves
+// are created by the migrations NewDB applies.
 func (db *DB) InitSchema(logger common.Logger) error {
-	// Create tables
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS configs (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			broker_address TEXT NOT NULL,
-			username TEXT,
-			password TEXT,
-			client_id TEXT,
-			topic TEXT,
-			log_level TEXT,
-			script_timeout INTEGER,
-			created_at DATETIME,
-			updated_at DATETIME
-		);
-
-		CREATE TABLE IF NOT EXISTS script_configs (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL,
-			script_path TEXT NOT NULL,
-			run_as_user BOOLEAN,
-			script_timeout INTEGER,
-			created_at DATETIME,
-			updated_at DATETIME
-		);
-
-		CREATE TABLE IF NOT EXISTS sensor_configs (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL,
-			enabled BOOLEAN,
-			interval INTEGER,
-			sensor_topic TEXT,
-			created_at DATETIME,
-			updated_at DATETIME
-		);
-
-		CREATE TABLE IF NOT EXISTS hotkey_commands (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			hotkey TEXT,
-			command TEXT,
-			created_at DATETIME,
-			updated_at DATETIME
-		);
-	`)
-
+	version, err := db.CurrentSchemaVersion()
 	if err != nil {
 		return err
 	}
+	logger.Debug(fmt.Sprintf("Database schema is at version %d", version))
+
 	// Check if the default data already exists
 	var defaultDataExists bool
 	err = db.QueryRow("SELECT id FROM configs LIMIT 1").Scan(&defaultDataExists)
@@ -158,7 +127,7 @@ func (db *DB) AddScriptsFromDir() error {
 func (db *DB) GetConfig() (*common.Config, error) {
 	var configModel common.ConfigModel
 
-	err := db.QueryRow("SELECT id, broker_address, username, password, client_id, topic, log_level, script_timeout, created_at, updated_at FROM configs ORDER BY id DESC LIMIT 1").Scan(
+	err := db.QueryRow("SELECT id, broker_address, username, password, client_id, topic, log_level, script_timeout, legacy_responses, status_topic, payload_online, payload_offline, tls_ca_file, tls_cert_file, tls_key_file, tls_server_name, tls_insecure_skip_verify, max_concurrent_scripts, http_listen_address, http_port, http_tls_cert_file, http_tls_key_file, http_tls_self_signed, cors_allowed_origins, log_max_size_mb, log_max_age_hours, log_max_files, log_compress, log_format, created_at, updated_at FROM configs ORDER BY id DESC LIMIT 1").Scan(
 		&configModel.ID,
 		&configModel.BrokerAddress,
 		&configModel.Username,
@@ -167,6 +136,27 @@ func (db *DB) GetConfig() (*common.Config, error) {
 		&configModel.Topic,
 		&configModel.LogLevel,
 		&configModel.ScriptTimeout,
+		&configModel.LegacyResponses,
+		&configModel.StatusTopic,
+		&configModel.PayloadOnline,
+		&configModel.PayloadOffline,
+		&configModel.TLSCAFile,
+		&configModel.TLSCertFile,
+		&configModel.TLSKeyFile,
+		&configModel.TLSServerName,
+		&configModel.TLSInsecure,
+		&configModel.MaxConcurrent,
+		&configModel.HTTPListenAddress,
+		&configModel.HTTPPort,
+		&configModel.HTTPTLSCertFile,
+		&configModel.HTTPTLSKeyFile,
+		&configModel.HTTPSelfSigned,
+		&configModel.CORSAllowedOrigins,
+		&configModel.LogMaxSize,
+		&configModel.LogMaxAge,
+		&configModel.LogMaxFiles,
+		&configModel.LogCompress,
+		&configModel.LogFormat,
 		&configModel.CreatedAt,
 		&configModel.UpdatedAt,
 	)
@@ -201,6 +191,27 @@ func (db *DB) GetConfig() (*common.Config, error) {
 		Topic:               configModel.Topic,
 		LogLevel:            configModel.LogLevel,
 		ScriptTimeout:       configModel.ScriptTimeout,
+		LegacyResponses:     configModel.LegacyResponses,
+		StatusTopic:         configModel.StatusTopic,
+		PayloadOnline:       configModel.PayloadOnline,
+		PayloadOffline:      configModel.PayloadOffline,
+		TLSCAFile:           configModel.TLSCAFile,
+		TLSCertFile:         configModel.TLSCertFile,
+		TLSKeyFile:          configModel.TLSKeyFile,
+		TLSServerName:       configModel.TLSServerName,
+		TLSInsecure:         configModel.TLSInsecure,
+		MaxConcurrent:       configModel.MaxConcurrent,
+		HTTPListenAddress:   configModel.HTTPListenAddress,
+		HTTPPort:            configModel.HTTPPort,
+		HTTPTLSCertFile:     configModel.HTTPTLSCertFile,
+		HTTPTLSKeyFile:      configModel.HTTPTLSKeyFile,
+		HTTPSelfSigned:      configModel.HTTPSelfSigned,
+		CORSAllowedOrigins:  configModel.CORSAllowedOrigins,
+		LogMaxSize:          configModel.LogMaxSize,
+		LogMaxAge:           configModel.LogMaxAge,
+		LogMaxFiles:         configModel.LogMaxFiles,
+		LogCompress:         configModel.LogCompress,
+		LogFormat:           configModel.LogFormat,
 		SensorConfigEnabled: false,
 		Commands:            configsScriptArray,
 		Sensors:             configsSensorArray,
@@ -210,7 +221,7 @@ func (db *DB) GetConfig() (*common.Config, error) {
 }
 
 func (db *DB) GetScriptConfigs() (*common.ScriptConfigs, error) {
-	rows, err := db.Query("SELECT id, name, script_path, run_as_user, script_timeout, created_at, updated_at FROM script_configs ORDER BY id DESC")
+	rows, err := db.Query("SELECT id, name, script_path, run_as_user, script_timeout, interpreter, interpreter_args, concurrency, created_at, updated_at FROM script_configs ORDER BY id DESC")
 	if err != nil {
 		return nil, fmt.Errorf("failed to query script configs: %v", err)
 	}
@@ -219,7 +230,7 @@ func (db *DB) GetScriptConfigs() (*common.ScriptConfigs, error) {
 	var scriptConfigs common.ScriptConfigs
 	for rows.Next() {
 		var sc common.ScriptConfig
-		err := rows.Scan(&sc.ID, &sc.Name, &sc.ScriptPath, &sc.RunAsUser, &sc.ScriptTimeout, &sc.CreatedAt, &sc.UpdatedAt)
+		err := rows.Scan(&sc.ID, &sc.Name, &sc.ScriptPath, &sc.RunAsUser, &sc.ScriptTimeout, &sc.Interpreter, &sc.InterpreterArgs, &sc.Concurrency, &sc.CreatedAt, &sc.UpdatedAt)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan script config: %v", err)
 		}
@@ -230,12 +241,15 @@ func (db *DB) GetScriptConfigs() (*common.ScriptConfigs, error) {
 
 func (db *DB) GetScriptConfig(id int64) (*common.ScriptConfig, error) {
 	var scriptConfig common.ScriptConfig
-	err := db.QueryRow("SELECT id, name, script_path, run_as_user, script_timeout, created_at, updated_at FROM script_configs WHERE id = ? ORDER BY id DESC LIMIT 1", id).Scan(
+	err := db.QueryRow("SELECT id, name, script_path, run_as_user, script_timeout, interpreter, interpreter_args, concurrency, created_at, updated_at FROM script_configs WHERE id = ? ORDER BY id DESC LIMIT 1", id).Scan(
 		&scriptConfig.ID,
 		&scriptConfig.Name,
 		&scriptConfig.ScriptPath,
 		&scriptConfig.RunAsUser,
 		&scriptConfig.ScriptTimeout,
+		&scriptConfig.Interpreter,
+		&scriptConfig.InterpreterArgs,
+		&scriptConfig.Concurrency,
 		&scriptConfig.CreatedAt,
 		&scriptConfig.UpdatedAt,
 	)
@@ -269,11 +283,21 @@ func (db *DB) SaveConfig(config *common.Config) error {
 	_, err := db.Exec(`
 		INSERT INTO configs (
 			broker_address, username, password, client_id, topic,
-			log_level, script_timeout, created_at, updated_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			log_level, script_timeout, legacy_responses, status_topic,
+			payload_online, payload_offline, tls_ca_file, tls_cert_file, tls_key_file,
+			tls_server_name, tls_insecure_skip_verify, max_concurrent_scripts,
+			http_listen_address, http_port, http_tls_cert_file, http_tls_key_file, http_tls_self_signed,
+			cors_allowed_origins, log_max_size_mb, log_max_age_hours, log_max_files, log_compress,
+			log_format, created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		config.BrokerAddress, config.Username, config.Password,
 		config.ClientID, config.Topic, config.LogLevel,
-		config.ScriptTimeout, now, now,
+		config.ScriptTimeout, config.LegacyResponses, config.StatusTopic,
+		config.PayloadOnline, config.PayloadOffline, config.TLSCAFile, config.TLSCertFile, config.TLSKeyFile,
+		config.TLSServerName, config.TLSInsecure, config.MaxConcurrent,
+		config.HTTPListenAddress, config.HTTPPort, config.HTTPTLSCertFile, config.HTTPTLSKeyFile, config.HTTPSelfSigned,
+		config.CORSAllowedOrigins, config.LogMaxSize, config.LogMaxAge, config.LogMaxFiles, config.LogCompress,
+		config.LogFormat, now, now,
 	)
 	return err
 }
@@ -283,11 +307,21 @@ func (db *DB) UpdateConfig(config *common.Config) error {
 	_, err := db.Exec(`
 		UPDATE configs SET
 			broker_address = ?, username = ?, password = ?, client_id = ?, topic = ?,
-			log_level = ?, script_timeout = ?, updated_at = ?
+			log_level = ?, script_timeout = ?, legacy_responses = ?, status_topic = ?,
+			payload_online = ?, payload_offline = ?, tls_ca_file = ?, tls_cert_file = ?, tls_key_file = ?,
+			tls_server_name = ?, tls_insecure_skip_verify = ?, max_concurrent_scripts = ?,
+			http_listen_address = ?, http_port = ?, http_tls_cert_file = ?, http_tls_key_file = ?,
+			http_tls_self_signed = ?, cors_allowed_origins = ?, log_max_size_mb = ?, log_max_age_hours = ?,
+			log_max_files = ?, log_compress = ?, log_format = ?, updated_at = ?
 		WHERE id = ?`,
 		config.BrokerAddress, config.Username, config.Password,
 		config.ClientID, config.Topic, config.LogLevel,
-		config.ScriptTimeout, now,
+		config.ScriptTimeout, config.LegacyResponses, config.StatusTopic,
+		config.PayloadOnline, config.PayloadOffline, config.TLSCAFile, config.TLSCertFile, config.TLSKeyFile,
+		config.TLSServerName, config.TLSInsecure, config.MaxConcurrent,
+		config.HTTPListenAddress, config.HTTPPort, config.HTTPTLSCertFile, config.HTTPTLSKeyFile,
+		config.HTTPSelfSigned, config.CORSAllowedOrigins, config.LogMaxSize, config.LogMaxAge,
+		config.LogMaxFiles, config.LogCompress, config.LogFormat, now,
 		config.ID,
 	)
 	return err
@@ -343,17 +377,63 @@ func (db *DB) CreateSensorConfig(sensorConfig *common.SensorConfig) error {
 
 func (db *DB) CreateScriptConfig(scriptConf *common.ScriptConfig) error {
 	now := time.Now()
-	_, err := db.Exec(`
+	result, err := db.Exec(`
 		INSERT INTO script_configs (
-			name, script_path, run_as_user, script_timeout, created_at, updated_at
-		) VALUES (?, ?, ?, ?, ?, ?)`,
+			name, script_path, run_as_user, script_timeout, interpreter, interpreter_args, concurrency, created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		scriptConf.Name,
 		scriptConf.ScriptPath,
 		scriptConf.RunAsUser,
 		scriptConf.ScriptTimeout,
+		scriptConf.Interpreter,
+		scriptConf.InterpreterArgs,
+		scriptConf.Concurrency,
 		now,
 		now,
 	)
+	if err != nil {
+		return err
+	}
+	scriptConf.ID, err = result.LastInsertId()
+	scriptConf.CreatedAt = now
+	scriptConf.UpdatedAt = now
+	return err
+}
+
+func (db *DB) UpdateScriptConfig(scriptConf *common.ScriptConfig) error {
+	now := time.Now()
+	_, err := db.Exec(`
+		UPDATE script_configs SET
+			name = ?, script_path = ?, run_as_user = ?, script_timeout = ?, interpreter = ?, interpreter_args = ?, concurrency = ?, updated_at = ?
+		WHERE id = ?`,
+		scriptConf.Name,
+		scriptConf.ScriptPath,
+		scriptConf.RunAsUser,
+		scriptConf.ScriptTimeout,
+		scriptConf.Interpreter,
+		scriptConf.InterpreterArgs,
+		scriptConf.Concurrency,
+		now,
+		scriptConf.ID,
+	)
+	if err != nil {
+		return err
+	}
+	scriptConf.UpdatedAt = now
+	return nil
+}
+
+func (db *DB) DeleteScriptConfig(id int64) error {
+	_, err := db.Exec("DELETE FROM script_configs WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	// Schedules can't run without their script, rules only lose their action
+	_, err = db.Exec("DELETE FROM schedules WHERE script_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE sensor_rules SET script_id = 0 WHERE script_id = ?", id)
 	return err
 }
 
@@ -375,3 +455,512 @@ func (db *DB) GetHotkeyCommands() ([]common.HotkeyCommand, error) {
 	}
 	return hotkeyCommands, nil
 }
+
+func (db *DB) CreateScriptRun(run *common.ScriptRun) error {
+	result, err := db.Exec(`
+		INSERT INTO script_runs (
+			command, source, request_id, status, exit_code, stdout, stderr, started_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.Command,
+		run.Source,
+		run.RequestID,
+		run.Status,
+		run.ExitCode,
+		run.Stdout,
+		run.Stderr,
+		run.StartedAt,
+	)
+	if err != nil {
+		return err
+	}
+	run.ID, err = result.LastInsertId()
+	return err
+}
+
+func (db *DB) UpdateScriptRun(run *common.ScriptRun) error {
+	_, err := db.Exec(`
+		UPDATE script_runs SET
+			status = ?, exit_code = ?, stdout = ?, stderr = ?, ended_at = ?
+		WHERE id = ?`,
+		run.Status,
+		run.ExitCode,
+		run.Stdout,
+		run.Stderr,
+		run.EndedAt,
+		run.ID,
+	)
+	return err
+}
+
+// MarkInterruptedScriptRuns flags runs that were still in progress when the
+// service last stopped, so they don't show up as running forever.
+func (db *DB) MarkInterruptedScriptRuns() error {
+	_, err := db.Exec("UPDATE script_runs SET status = 'interrupted', ended_at = ? WHERE status IN ('queued', 'running')", time.Now())
+	return err
+}
+
+func (db *DB) GetScriptRun(id int64) (*common.ScriptRun, error) {
+	row := db.QueryRow("SELECT id, command, source, request_id, status, exit_code, stdout, stderr, started_at, ended_at FROM script_runs WHERE id = ?", id)
+	run, err := scanScriptRun(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get script run: %v", err)
+	}
+	return run, nil
+}
+
+func (db *DB) GetScriptRuns(filter common.ScriptRunFilter) (*common.ScriptRuns, error) {
+	query := "SELECT id, command, source, request_id, status, exit_code, stdout, stderr, started_at, ended_at FROM script_runs WHERE 1 = 1"
+	var args []interface{}
+	if filter.Command != "" {
+		query += " AND command = ?"
+		args = append(args, filter.Command)
+	}
+	if filter.Status != "" {
+		query += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND started_at >= ?"
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query += " AND started_at <= ?"
+		args = append(args, filter.Until)
+	}
+	query += " ORDER BY started_at DESC, id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query script runs: %v", err)
+	}
+	defer rows.Close()
+
+	scriptRuns := common.ScriptRuns{}
+	for rows.Next() {
+		run, err := scanScriptRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan script run: %v", err)
+		}
+		scriptRuns = append(scriptRuns, *run)
+	}
+	return &scriptRuns, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanScriptRun(row rowScanner) (*common.ScriptRun, error) {
+	var run common.ScriptRun
+	var source, requestID, stdout, stderr sql.NullString
+	var exitCode sql.NullInt64
+	var endedAt sql.NullTime
+	err := row.Scan(&run.ID, &run.Command, &source, &requestID, &run.Status, &exitCode, &stdout, &stderr, &run.StartedAt, &endedAt)
+	if err != nil {
+		return nil, err
+	}
+	run.Source = source.String
+	run.RequestID = requestID.String
+	run.ExitCode = int(exitCode.Int64)
+	run.Stdout = stdout.String
+	run.Stderr = stderr.String
+	run.EndedAt = endedAt.Time
+	return &run, nil
+}
+
+func (db *DB) GetSchedules() (*common.Schedules, error) {
+	rows, err := db.Query("SELECT id, name, script_id, cron, interval, timezone, jitter, missed_run_policy, enabled, last_run_at, created_at, updated_at FROM schedules ORDER BY id DESC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schedules: %v", err)
+	}
+	defer rows.Close()
+
+	schedules := common.Schedules{}
+	for rows.Next() {
+		schedule, err := scanSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %v", err)
+		}
+		schedules = append(schedules, *schedule)
+	}
+	return &schedules, nil
+}
+
+func (db *DB) GetSchedule(id int64) (*common.Schedule, error) {
+	row := db.QueryRow("SELECT id, name, script_id, cron, interval, timezone, jitter, missed_run_policy, enabled, last_run_at, created_at, updated_at FROM schedules WHERE id = ?", id)
+	schedule, err := scanSchedule(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schedule: %v", err)
+	}
+	return schedule, nil
+}
+
+func (db *DB) CreateSchedule(schedule *common.Schedule) error {
+	now := time.Now()
+	result, err := db.Exec(`
+		INSERT INTO schedules (
+			name, script_id, cron, interval, timezone, jitter, missed_run_policy, enabled, created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		schedule.Name,
+		schedule.ScriptID,
+		schedule.Cron,
+		schedule.Interval,
+		schedule.Timezone,
+		schedule.Jitter,
+		schedule.MissedRunPolicy,
+		schedule.Enabled,
+		now,
+		now,
+	)
+	if err != nil {
+		return err
+	}
+	schedule.ID, err = result.LastInsertId()
+	schedule.CreatedAt = now
+	schedule.UpdatedAt = now
+	return err
+}
+
+func (db *DB) UpdateSchedule(schedule *common.Schedule) error {
+	now := time.Now()
+	_, err := db.Exec(`
+		UPDATE schedules SET
+			name = ?, script_id = ?, cron = ?, interval = ?, timezone = ?, jitter = ?,
+			missed_run_policy = ?, enabled = ?, updated_at = ?
+		WHERE id = ?`,
+		schedule.Name,
+		schedule.ScriptID,
+		schedule.Cron,
+		schedule.Interval,
+		schedule.Timezone,
+		schedule.Jitter,
+		schedule.MissedRunPolicy,
+		schedule.Enabled,
+		now,
+		schedule.ID,
+	)
+	if err != nil {
+		return err
+	}
+	schedule.UpdatedAt = now
+	return nil
+}
+
+// UpdateScheduleLastRun records when a schedule last fired, which is used to
+// detect runs that were missed while the service was down.
+func (db *DB) UpdateScheduleLastRun(id int64, lastRunAt time.Time) error {
+	_, err := db.Exec("UPDATE schedules SET last_run_at = ? WHERE id = ?", lastRunAt, id)
+	return err
+}
+
+func (db *DB) DeleteSchedule(id int64) error {
+	_, err := db.Exec("DELETE FROM schedules WHERE id = ?", id)
+	return err
+}
+
+func scanSchedule(row rowScanner) (*common.Schedule, error) {
+	var schedule common.Schedule
+	var lastRunAt sql.NullTime
+	err := row.Scan(
+		&schedule.ID,
+		&schedule.Name,
+		&schedule.ScriptID,
+		&schedule.Cron,
+		&schedule.Interval,
+		&schedule.Timezone,
+		&schedule.Jitter,
+		&schedule.MissedRunPolicy,
+		&schedule.Enabled,
+		&lastRunAt,
+		&schedule.CreatedAt,
+		&schedule.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	schedule.LastRunAt = lastRunAt.Time
+	return &schedule, nil
+}
+
+func (db *DB) GetSensorRules() (*common.SensorRules, error) {
+	rows, err := db.Query("SELECT id, name, sensor, operator, threshold, duration, hysteresis, interval, script_id, alert_topic, enabled, created_at, updated_at FROM sensor_rules ORDER BY id DESC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sensor rules: %v", err)
+	}
+	defer rows.Close()
+
+	rules := common.SensorRules{}
+	for rows.Next() {
+		rule, err := scanSensorRule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan sensor rule: %v", err)
+		}
+		rules = append(rules, *rule)
+	}
+	return &rules, nil
+}
+
+func (db *DB) GetSensorRule(id int64) (*common.SensorRule, error) {
+	row := db.QueryRow("SELECT id, name, sensor, operator, threshold, duration, hysteresis, interval, script_id, alert_topic, enabled, created_at, updated_at FROM sensor_rules WHERE id = ?", id)
+	rule, err := scanSensorRule(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sensor rule: %v", err)
+	}
+	return rule, nil
+}
+
+func (db *DB) CreateSensorRule(rule *common.SensorRule) error {
+	now := time.Now()
+	result, err := db.Exec(`
+		INSERT INTO sensor_rules (
+			name, sensor, operator, threshold, duration, hysteresis, interval, script_id, alert_topic, enabled, created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rule.Name,
+		rule.Sensor,
+		rule.Operator,
+		rule.Threshold,
+		rule.Duration,
+		rule.Hysteresis,
+		rule.Interval,
+		rule.ScriptID,
+		rule.AlertTopic,
+		rule.Enabled,
+		now,
+		now,
+	)
+	if err != nil {
+		return err
+	}
+	rule.ID, err = result.LastInsertId()
+	rule.CreatedAt = now
+	rule.UpdatedAt = now
+	return err
+}
+
+func (db *DB) UpdateSensorRule(rule *common.SensorRule) error {
+	now := time.Now()
+	_, err := db.Exec(`
+		UPDATE sensor_rules SET
+			name = ?, sensor = ?, operator = ?, threshold = ?, duration = ?, hysteresis = ?,
+			interval = ?, script_id = ?, alert_topic = ?, enabled = ?, updated_at = ?
+		WHERE id = ?`,
+		rule.Name,
+		rule.Sensor,
+		rule.Operator,
+		rule.Threshold,
+		rule.Duration,
+		rule.Hysteresis,
+		rule.Interval,
+		rule.ScriptID,
+		rule.AlertTopic,
+		rule.Enabled,
+		now,
+		rule.ID,
+	)
+	if err != nil {
+		return err
+	}
+	rule.UpdatedAt = now
+	return nil
+}
+
+func (db *DB) DeleteSensorRule(id int64) error {
+	_, err := db.Exec("DELETE FROM sensor_rules WHERE id = ?", id)
+	return err
+}
+
+func scanSensorRule(row rowScanner) (*common.SensorRule, error) {
+	var rule common.SensorRule
+	err := row.Scan(
+		&rule.ID,
+		&rule.Name,
+		&rule.Sensor,
+		&rule.Operator,
+		&rule.Threshold,
+		&rule.Duration,
+		&rule.Hysteresis,
+		&rule.Interval,
+		&rule.ScriptID,
+		&rule.AlertTopic,
+		&rule.Enabled,
+		&rule.CreatedAt,
+		&rule.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func (db *DB) CountUsers() (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
+
+func (db *DB) GetUserByUsername(username string) (*common.User, error) {
+	var user common.User
+	err := db.QueryRow("SELECT id, username, password_hash, created_at, updated_at FROM users WHERE username = ?", username).Scan(
+		&user.ID,
+		&user.Username,
+		&user.PasswordHash,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateFirstUser creates user only while the users table is empty, so two
+// concurrent setup requests can't both succeed. It reports whether the user
+// was created.
+func (db *DB) CreateFirstUser(user *common.User) (bool, error) {
+	now := time.Now()
+	result, err := db.Exec(`
+		INSERT INTO users (username, password_hash, created_at, updated_at)
+		SELECT ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM users)`,
+		user.Username,
+		user.PasswordHash,
+		now,
+		now,
+	)
+	if err != nil {
+		return false, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return false, err
+	}
+	user.ID, err = result.LastInsertId()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	return true, err
+}
+
+func (db *DB) CreateSession(session *common.Session) error {
+	now := time.Now()
+	result, err := db.Exec(
+		"INSERT INTO sessions (token_hash, user_id, expires_at, created_at) VALUES (?, ?, ?, ?)",
+		session.TokenHash,
+		session.UserID,
+		session.ExpiresAt,
+		now,
+	)
+	if err != nil {
+		return err
+	}
+	session.ID, err = result.LastInsertId()
+	session.CreatedAt = now
+	return err
+}
+
+// GetSessionUser returns the user of an unexpired session.
+func (db *DB) GetSessionUser(tokenHash string) (*common.User, error) {
+	var user common.User
+	err := db.QueryRow(`
+		SELECT u.id, u.username, u.password_hash, u.created_at, u.updated_at
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > ?`, tokenHash, time.Now()).Scan(
+		&user.ID,
+		&user.Username,
+		&user.PasswordHash,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (db *DB) DeleteSession(tokenHash string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE token_hash = ?", tokenHash)
+	return err
+}
+
+func (db *DB) DeleteExpiredSessions() error {
+	_, err := db.Exec("DELETE FROM sessions WHERE expires_at <= ?", time.Now())
+	return err
+}
+
+func (db *DB) GetAPITokens() (*common.APITokens, error) {
+	rows, err := db.Query("SELECT id, name, token_hash, last_used_at, created_at FROM api_tokens ORDER BY id DESC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API tokens: %v", err)
+	}
+	defer rows.Close()
+
+	tokens := common.APITokens{}
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API token: %v", err)
+		}
+		tokens = append(tokens, *token)
+	}
+	return &tokens, nil
+}
+
+func (db *DB) GetAPITokenByHash(tokenHash string) (*common.APIToken, error) {
+	row := db.QueryRow("SELECT id, name, token_hash, last_used_at, created_at FROM api_tokens WHERE token_hash = ?", tokenHash)
+	return scanAPIToken(row)
+}
+
+func (db *DB) CreateAPIToken(token *common.APIToken) error {
+	now := time.Now()
+	result, err := db.Exec(
+		"INSERT INTO api_tokens (name, token_hash, created_at) VALUES (?, ?, ?)",
+		token.Name,
+		token.TokenHash,
+		now,
+	)
+	if err != nil {
+		return err
+	}
+	token.ID, err = result.LastInsertId()
+	token.CreatedAt = now
+	return err
+}
+
+func (db *DB) UpdateAPITokenLastUsed(id int64, lastUsedAt time.Time) error {
+	_, err := db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", lastUsedAt, id)
+	return err
+}
+
+// DeleteAPIToken revokes a token. It returns sql.ErrNoRows when the token
+// doesn't exist.
+func (db *DB) DeleteAPIToken(id int64) error {
+	result, err := db.Exec("DELETE FROM api_tokens WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanAPIToken(row rowScanner) (*common.APIToken, error) {
+	var token common.APIToken
+	var lastUsedAt sql.NullTime
+	err := row.Scan(
+		&token.ID,
+		&token.Name,
+		&token.TokenHash,
+		&lastUsedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	token.LastUsedAt = lastUsedAt.Time
+	return &token, nil
+}
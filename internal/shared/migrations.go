@@ -0,0 +1,293 @@
+package shared
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer version
+// of the service than the running one.
+var ErrSchemaTooNew = errors.New("database schema is newer than this version supports")
+
+// migration is one step of the database schema. Migrations are applied in
+// order, each in its own transaction, and recorded in schema_migrations. Once
+// released a migration must never change; add a new one instead.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// column is a column added to an existing table.
+type column struct {
+	table      string
+	name       string
+	definition string
+}
+
+var migrations = []migration{
+	{1, "initial schema", execMigration(`
+		CREATE TABLE IF NOT EXISTS configs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			broker_address TEXT NOT NULL,
+			username TEXT,
+			password TEXT,
+			client_id TEXT,
+			topic TEXT,
+			log_level TEXT,
+			script_timeout INTEGER,
+			created_at DATETIME,
+			updated_at DATETIME
+		);
+
+		CREATE TABLE IF NOT EXISTS script_configs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			script_path TEXT NOT NULL,
+			run_as_user BOOLEAN,
+			script_timeout INTEGER,
+			created_at DATETIME,
+			updated_at DATETIME
+		);
+
+		CREATE TABLE IF NOT EXISTS sensor_configs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			enabled BOOLEAN,
+			interval INTEGER,
+			sensor_topic TEXT,
+			created_at DATETIME,
+			updated_at DATETIME
+		);
+
+		CREATE TABLE IF NOT EXISTS hotkey_commands (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			hotkey TEXT,
+			command TEXT,
+			created_at DATETIME,
+			updated_at DATETIME
+		);
+	`)},
+	{2, "script run history", execMigration(`
+		CREATE TABLE IF NOT EXISTS script_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			command TEXT NOT NULL,
+			source TEXT,
+			request_id TEXT,
+			status TEXT,
+			exit_code INTEGER,
+			stdout TEXT,
+			stderr TEXT,
+			started_at DATETIME,
+			ended_at DATETIME
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_script_runs_started_at ON script_runs (started_at);
+	`)},
+	{3, "legacy responses", addColumns(
+		column{"configs", "legacy_responses", "BOOLEAN DEFAULT false"},
+	)},
+	{4, "MQTT availability", addColumns(
+		column{"configs", "status_topic", "TEXT DEFAULT ''"},
+		column{"configs", "payload_online", "TEXT DEFAULT 'online'"},
+		column{"configs", "payload_offline", "TEXT DEFAULT 'offline'"},
+	)},
+	{5, "broker TLS", addColumns(
+		column{"configs", "tls_ca_file", "TEXT DEFAULT ''"},
+		column{"configs", "tls_cert_file", "TEXT DEFAULT ''"},
+		column{"configs", "tls_key_file", "TEXT DEFAULT ''"},
+		column{"configs", "tls_server_name", "TEXT DEFAULT ''"},
+		column{"configs", "tls_insecure_skip_verify", "BOOLEAN DEFAULT false"},
+	)},
+	{6, "script interpreters", addColumns(
+		column{"script_configs", "interpreter", "TEXT DEFAULT ''"},
+		column{"script_configs", "interpreter_args", "TEXT DEFAULT ''"},
+	)},
+	{7, "script concurrency", addColumns(
+		column{"script_configs", "concurrency", "TEXT DEFAULT 'parallel'"},
+		column{"configs", "max_concurrent_scripts", "INTEGER DEFAULT 0"},
+	)},
+	{8, "schedules", execMigration(`
+		CREATE TABLE IF NOT EXISTS schedules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			script_id INTEGER NOT NULL,
+			cron TEXT DEFAULT '',
+			interval INTEGER DEFAULT 0,
+			timezone TEXT DEFAULT '',
+			jitter INTEGER DEFAULT 0,
+			missed_run_policy TEXT DEFAULT 'skip',
+			enabled BOOLEAN DEFAULT true,
+			last_run_at DATETIME,
+			created_at DATETIME,
+			updated_at DATETIME
+		);
+	`)},
+	{9, "sensor rules", execMigration(`
+		CREATE TABLE IF NOT EXISTS sensor_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			sensor TEXT NOT NULL,
+			operator TEXT NOT NULL,
+			threshold REAL NOT NULL,
+			duration INTEGER DEFAULT 0,
+			hysteresis REAL DEFAULT 0,
+			interval INTEGER DEFAULT 10,
+			script_id INTEGER DEFAULT 0,
+			alert_topic TEXT DEFAULT '',
+			enabled BOOLEAN DEFAULT true,
+			created_at DATETIME,
+			updated_at DATETIME
+		);
+	`)},
+	{10, "authentication", execMigration(`
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			created_at DATETIME,
+			updated_at DATETIME
+		);
+
+		CREATE TABLE IF NOT EXISTS sessions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token_hash TEXT NOT NULL UNIQUE,
+			user_id INTEGER NOT NULL,
+			expires_at DATETIME NOT NULL,
+			created_at DATETIME
+		);
+
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			last_used_at DATETIME,
+			created_at DATETIME
+		);
+	`)},
+	{11, "HTTP server settings", addColumns(
+		column{"configs", "http_listen_address", "TEXT DEFAULT '0.0.0.0'"},
+		column{"configs", "http_port", "INTEGER DEFAULT 8077"},
+		column{"configs", "http_tls_cert_file", "TEXT DEFAULT ''"},
+		column{"configs", "http_tls_key_file", "TEXT DEFAULT ''"},
+		column{"configs", "http_tls_self_signed", "BOOLEAN DEFAULT false"},
+		column{"configs", "cors_allowed_origins", "TEXT DEFAULT ''"},
+	)},
+	{12, "log rotation", addColumns(
+		column{"configs", "log_max_size_mb", "INTEGER DEFAULT 10"},
+		column{"configs", "log_max_age_hours", "INTEGER DEFAULT 24"},
+		column{"configs", "log_max_files", "INTEGER DEFAULT 5"},
+		column{"configs", "log_compress", "BOOLEAN DEFAULT false"},
+	)},
+	{13, "log format", addColumns(
+		column{"configs", "log_format", "TEXT DEFAULT 'text'"},
+	)},
+}
+
+// SchemaVersion returns the version of the newest migration this build knows.
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate brings the database schema up to date. It refuses to touch a
+// database that was migrated by a newer build, since that build may have
+// changed tables in ways this one doesn't understand.
+func (db *DB) Migrate() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			description TEXT,
+			applied_at DATETIME
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+
+	current, err := db.CurrentSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > SchemaVersion() {
+		return fmt.Errorf("%w: database is at version %d, this build supports up to version %d", ErrSchemaTooNew, current, SchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := db.applyMigration(m); err != nil {
+			return fmt.Errorf("failed to apply migration %d (%s): %v", m.version, m.description, err)
+		}
+	}
+	return nil
+}
+
+// CurrentSchemaVersion returns the version of the last applied migration.
+func (db *DB) CurrentSchemaVersion() (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %v", err)
+	}
+	return version, nil
+}
+
+func (db *DB) applyMigration(m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The service and the systray migrate at startup, the other one may have
+	// applied it already
+	var applied bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = ?)", m.version).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)", m.version, m.description, time.Now())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func execMigration(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// addColumns adds columns that don't exist yet. Databases created before
+// migrations existed may already have some of them.
+func addColumns(columns ...column) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, c := range columns {
+			exists, err := columnExists(tx, c.table, c.name)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.name, c.definition)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func columnExists(tx *sql.Tx, table, name string) (bool, error) {
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, name).Scan(&count)
+	return count > 0, err
+}
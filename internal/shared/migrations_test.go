@@ -0,0 +1,240 @@
+package shared
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// baselineSchema is the schema InitSchema created before migrations existed.
+const baselineSchema = `
+	CREATE TABLE configs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		broker_address TEXT NOT NULL,
+		username TEXT,
+		password TEXT,
+		client_id TEXT,
+		topic TEXT,
+		log_level TEXT,
+		script_timeout INTEGER,
+		created_at DATETIME,
+		updated_at DATETIME
+	);
+
+	CREATE TABLE script_configs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		script_path TEXT NOT NULL,
+		run_as_user BOOLEAN,
+		script_timeout INTEGER,
+		created_at DATETIME,
+		updated_at DATETIME
+	);
+
+	CREATE TABLE sensor_configs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		enabled BOOLEAN,
+		interval INTEGER,
+		sensor_topic TEXT,
+		created_at DATETIME,
+		updated_at DATETIME
+	);
+
+	CREATE TABLE hotkey_commands (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		hotkey TEXT,
+		command TEXT,
+		created_at DATETIME,
+		updated_at DATETIME
+	);
+
+	INSERT INTO configs (id, broker_address, username, password, client_id, topic, log_level, script_timeout)
+	VALUES (1, 'tcp://broker:1883', 'user', 'secret', 'client', 'windows/commands', 'debug', 300);
+
+	INSERT INTO script_configs (id, name, script_path, run_as_user, script_timeout)
+	VALUES (1, 'backup', 'backup.ps1', false, 60);
+`
+
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "store.db")+"?_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &DB{db}
+}
+
+func (db *DB) mustExec(t *testing.T, query string) {
+	t.Helper()
+	if _, err := db.Exec(query); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkMigrated fails the test unless every migration is recorded and every
+// column the migrations add exists.
+func checkMigrated(t *testing.T, db *DB) {
+	t.Helper()
+	version, err := db.CurrentSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion() {
+		t.Fatalf("schema version = %d, want %d", version, SchemaVersion())
+	}
+	var recorded int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&recorded); err != nil {
+		t.Fatal(err)
+	}
+	if recorded != len(migrations) {
+		t.Errorf("%d migrations recorded, want %d", recorded, len(migrations))
+	}
+
+	for _, table := range []string{"configs", "script_configs", "sensor_configs", "hotkey_commands", "script_runs", "schedules", "sensor_rules", "users", "sessions", "api_tokens"} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?)", table).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count == 0 {
+			t.Errorf("table %s is missing", table)
+		}
+	}
+	for _, c := range []struct{ table, name string }{
+		{"configs", "legacy_responses"},
+		{"configs", "status_topic"},
+		{"configs", "tls_insecure_skip_verify"},
+		{"configs", "max_concurrent_scripts"},
+		{"configs", "http_port"},
+		{"configs", "log_compress"},
+		{"configs", "log_format"},
+		{"script_configs", "interpreter"},
+		{"script_configs", "concurrency"},
+	} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", c.table, c.name).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count == 0 {
+			t.Errorf("column %s.%s is missing", c.table, c.name)
+		}
+	}
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t, db)
+
+	// A second start must not apply anything again
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrating again: %v", err)
+	}
+	checkMigrated(t, db)
+}
+
+func TestMigratePreMigrationDatabase(t *testing.T) {
+	db := openTestDB(t)
+	db.mustExec(t, baselineSchema)
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t, db)
+
+	var (
+		broker, statusTopic, payloadOnline, listenAddress, logFormat string
+		httpPort, logMaxFiles                                        int
+		legacyResponses                                              bool
+	)
+	err := db.QueryRow(`SELECT broker_address, legacy_responses, status_topic, payload_online,
+		http_listen_address, http_port, log_max_files, log_format FROM configs WHERE id = 1`).Scan(
+		&broker, &legacyResponses, &statusTopic, &payloadOnline, &listenAddress, &httpPort, &logMaxFiles, &logFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broker != "tcp://broker:1883" {
+		t.Errorf("broker_address = %q, existing data was lost", broker)
+	}
+	if legacyResponses || statusTopic != "" || payloadOnline != "online" || listenAddress != "0.0.0.0" ||
+		httpPort != 8077 || logMaxFiles != 5 || logFormat != "text" {
+		t.Errorf("new columns of an existing config don't have their defaults: legacy_responses=%v status_topic=%q payload_online=%q http_listen_address=%q http_port=%d log_max_files=%d log_format=%q",
+			legacyResponses, statusTopic, payloadOnline, listenAddress, httpPort, logMaxFiles, logFormat)
+	}
+
+	var interpreter, concurrency string
+	if err := db.QueryRow("SELECT interpreter, concurrency FROM script_configs WHERE id = 1").Scan(&interpreter, &concurrency); err != nil {
+		t.Fatal(err)
+	}
+	if interpreter != "" || concurrency != "parallel" {
+		t.Errorf("interpreter = %q, concurrency = %q, want the defaults", interpreter, concurrency)
+	}
+}
+
+// TestMigrateColumnsAlreadyPresent covers databases created by builds that
+// added columns to CREATE TABLE without recording a migration.
+func TestMigrateColumnsAlreadyPresent(t *testing.T) {
+	db := openTestDB(t)
+	db.mustExec(t, baselineSchema)
+	db.mustExec(t, `
+		ALTER TABLE configs ADD COLUMN legacy_responses BOOLEAN DEFAULT false;
+		ALTER TABLE configs ADD COLUMN status_topic TEXT DEFAULT '';
+		ALTER TABLE configs ADD COLUMN payload_online TEXT DEFAULT 'online';
+		ALTER TABLE script_configs ADD COLUMN interpreter TEXT DEFAULT '';
+		CREATE TABLE schedules (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL, script_id INTEGER NOT NULL);
+	`)
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t, db)
+}
+
+func TestMigratePartiallyMigratedDatabase(t *testing.T) {
+	db := openTestDB(t)
+	db.mustExec(t, baselineSchema)
+
+	// Apply the first migrations only, like an older build would have
+	all := migrations
+	migrations = all[:5]
+	err := db.Migrate()
+	migrations = all
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := db.CurrentSchemaVersion(); version != 5 {
+		t.Fatalf("schema version = %d, want 5", version)
+	}
+
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t, db)
+}
+
+func TestMigrateSchemaTooNew(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, description) VALUES (?, 'from the future')", SchemaVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Migrate(); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("err = %v, want %v", err, ErrSchemaTooNew)
+	}
+}
+
+func TestMigrationVersionsAreSequential(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d (%s) has version %d, want %d", i, m.description, m.version, i+1)
+		}
+		if m.description == "" {
+			t.Errorf("migration %d has no description", m.version)
+		}
+	}
+}